@@ -7,6 +7,7 @@ import (
 	"github.com/madejackson/cosmos-server/src/storage"
 	"github.com/madejackson/cosmos-server/src/docker"
 	"github.com/madejackson/cosmos-server/src/proxy"
+	"github.com/madejackson/cosmos-server/src/constellation"
 	"os"
 	"path/filepath"
 	"encoding/json"
@@ -127,12 +128,19 @@ func CRON() {
 		})
 		s.Every(1).Hours().Do(utils.CleanBannedIPs)
 		s.Every(1).Hours().Do(proxy.CleanUp)
+		s.Every(1).Hours().Do(func() {
+			constellation.RefreshDNSBlocklists(false)
+		})
 		s.Every(1).Day().At("2:00").Do(func() {
 			checkVersion()
 			utils.CleanupByDate("notifications")
 			utils.CleanupByDate("events")
+			utils.CleanupByDate("alerts")
+			utils.CleanupAccessLogs()
+			constellation.CleanupDNSLogs()
 			imageCleanUp()
 			checkCerts()
+			utils.CheckCertificatesExpiry()
 			checkUpdatesAvailable()
 		})
 
@@ -6,6 +6,7 @@ import (
 	"os"
 	"io/ioutil"
 	"github.com/madejackson/cosmos-server/src/utils" 
+	"github.com/madejackson/cosmos-server/src/proxy"
 )
 
 func ConfigApiGet(w http.ResponseWriter, req *http.Request) {
@@ -21,6 +22,10 @@ func ConfigApiGet(w http.ResponseWriter, req *http.Request) {
 		// delete AuthPrivateKey and TLSKey
 		config.HTTPConfig.AuthPrivateKey = ""
 		config.HTTPConfig.TLSKey = ""
+		config.HTTPConfig.ACMEEABHMACKey = ""
+		for i := range config.HTTPConfig.ProxyConfig.Routes {
+			config.HTTPConfig.ProxyConfig.Routes[i].TLSKey = ""
+		}
 
 		if !isAdmin {
 			config.MongoDB = "***"
@@ -41,12 +46,21 @@ func ConfigApiGet(w http.ResponseWriter, req *http.Request) {
 			config.HTTPConfig.ProxyConfig.Routes = filteredRoutes
 		}
 
+		routesHealth := map[string]proxy.RouteHealth{}
+		allHealth := proxy.GetRoutesHealth()
+		for _, route := range config.HTTPConfig.ProxyConfig.Routes {
+			if health, ok := allHealth[route.Name]; ok {
+				routesHealth[route.Name] = health
+			}
+		}
+
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "OK",
 			"data": config,
 			"updates": utils.UpdateAvailable,
 			"hostname": os.Getenv("HOSTNAME"),
 			"isAdmin": isAdmin,
+			"routesHealth": routesHealth,
 		})
 	} else {
 		utils.Error("SettingGet: Method not allowed" + req.Method, nil)
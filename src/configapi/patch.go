@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/madejackson/cosmos-server/src/proxy"
 	"github.com/madejackson/cosmos-server/src/utils"
 )
 
@@ -57,6 +58,14 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if updateReq.NewRoute != nil {
+		if errR := proxy.ValidateRouteMatching(*updateReq.NewRoute); errR != nil {
+			utils.Error("RouteSettingsUpdate: Invalid route", errR)
+			utils.HTTPError(w, "Invalid route matching rule: " + errR.Error(), http.StatusBadRequest, "UR005")
+			return
+		}
+	}
+
 	switch updateReq.Operation {
 		case "replace":
 			utils.Log("RouteSettingsUpdate: Replacing route: "+updateReq.RouteName)
@@ -65,6 +74,7 @@ func ConfigApiPatch(w http.ResponseWriter, req *http.Request) {
 				utils.HTTPError(w, "NewRoute must be provided for replace operation", http.StatusBadRequest, "UR003")
 				return
 			}
+			restoreRouteTLSKey(updateReq.NewRoute, routes)
 			routes[routeIndex] = *updateReq.NewRoute
 		case "move_up":
 			utils.Log("RouteSettingsUpdate: Moving up route: "+updateReq.RouteName)
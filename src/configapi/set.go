@@ -7,6 +7,7 @@ import (
 	"github.com/madejackson/cosmos-server/src/authorizationserver"
 	"github.com/madejackson/cosmos-server/src/constellation"
 	"github.com/madejackson/cosmos-server/src/cron"
+	"github.com/madejackson/cosmos-server/src/proxy"
 )
 
 func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
@@ -32,12 +33,27 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 			return 
 		}
 
+		for _, route := range request.HTTPConfig.ProxyConfig.Routes {
+			if errR := proxy.ValidateRouteMatching(route); errR != nil {
+				utils.Error("SettingsUpdate: Invalid route", errR)
+				utils.HTTPError(w, "Invalid route matching rule: " + errR.Error(),
+					http.StatusBadRequest, "UR005")
+				return 
+			}
+		}
+
 		// restore AuthPrivateKey and TLSKey
 		config := utils.ReadConfigFromFile()
 		request.HTTPConfig.AuthPrivateKey = config.HTTPConfig.AuthPrivateKey
 		request.HTTPConfig.AuthPublicKey = config.HTTPConfig.AuthPublicKey
 		request.HTTPConfig.TLSCert = config.HTTPConfig.TLSCert
 		request.HTTPConfig.TLSKey = config.HTTPConfig.TLSKey
+		if request.HTTPConfig.ACMEEABHMACKey == "" && request.HTTPConfig.ACMEEABKeyID == config.HTTPConfig.ACMEEABKeyID {
+			request.HTTPConfig.ACMEEABHMACKey = config.HTTPConfig.ACMEEABHMACKey
+		}
+		for i := range request.HTTPConfig.ProxyConfig.Routes {
+			restoreRouteTLSKey(&request.HTTPConfig.ProxyConfig.Routes[i], config.HTTPConfig.ProxyConfig.Routes)
+		}
 		request.NewInstall = config.NewInstall
 
 		utils.SetBaseMainConfig(request)
@@ -68,3 +84,17 @@ func ConfigApiSet(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+// route keys are not sent to the client, keep the saved one if the certificate did not change
+func restoreRouteTLSKey(route *utils.ProxyRouteConfig, previousRoutes []utils.ProxyRouteConfig) {
+	if route.TLSKey != "" || route.TLSCert == "" {
+		return
+	}
+
+	for _, previous := range previousRoutes {
+		if previous.Name == route.Name && previous.TLSCert == route.TLSCert {
+			route.TLSKey = previous.TLSKey
+			return
+		}
+	}
+}
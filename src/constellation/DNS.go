@@ -2,59 +2,81 @@ package constellation
 
 import (
 	"time"
-	"strconv"
 	"strings"
-	"io/ioutil"
+	"net"
 
 	"github.com/miekg/dns"
 	"github.com/madejackson/cosmos-server/src/utils" 
 )
 
-var DNSBlacklist = map[string]bool{}
-
-func externalLookup(client *dns.Client, r *dns.Msg, serverAddr string) (*dns.Msg, time.Duration, error) {
-	rCopy := r.Copy() // Create a copy of the request to forward
-	rCopy.Id = dns.Id() // Assign a new ID for the forwarded request
-	
-	// Enable DNSSEC
-	rCopy.SetEdns0(4096, true)
-	rCopy.CheckingDisabled = false
-	rCopy.MsgHdr.AuthenticatedData = true
-
-	return client.Exchange(rCopy, serverAddr)
+// dnsUDPSize is the largest response the client accepts over UDP
+func dnsUDPSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
 }
 
 func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	config := utils.GetMainConfig()
-	DNSFallback := config.ConstellationConfig.DNSFallback
-
-	if DNSFallback == "" {
-		DNSFallback = "8.8.8.8:53"
-	}
+	start := time.Now()
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
 
 	customHandled := false
+	source := DNS_SOURCE_UPSTREAM
+	cached := false
+
+	clientIP := dnsClientIP(w.RemoteAddr())
+	device, deviceFound := getDNSClientDevice(clientIP)
+	var policy *dnsPolicy
+	if deviceFound {
+		policy = getDNSClientPolicy(device)
+	}
+
+	// the entries of the policy first
+	zones := []map[string][]dnsRecord{getCustomDNSZone()}
+	if policy != nil {
+		zones = append([]map[string][]dnsRecord{policy.zone}, zones...)
+	}
 
 	// []string hostnames
 	hostnames := utils.GetAllHostnames(false, true)
 	
 	if !customHandled {
-		customDNSEntries := config.ConstellationConfig.CustomDNSEntries
-
 		// Overwrite local hostnames with custom entries
 		for _, q := range r.Question {
-			for _, entry := range customDNSEntries {
-				hostname := entry.Key
-				ip := entry.Value
+			var answers []dns.RR
+			var rcode int
+			handled := false
+			chase := ""
+			for _, zone := range zones {
+				answers, rcode, handled, chase = resolveCustomDNS(zone, q.Name, q.Qtype)
+				if handled {
+					break
+				}
+			}
+			if !handled {
+				continue
+			}
 
-				if strings.HasSuffix(q.Name, hostname + ".") && q.Qtype == dns.TypeA {
-					utils.Debug("DNS Overwrite " + hostname + " with " + ip)
-					rr, _ := dns.NewRR(q.Name + " A " + ip)
-					m.Answer = append(m.Answer, rr)
-					customHandled = true
+			utils.Debug("DNS Overwrite " + q.Name + " with custom entries")
+			m.Answer = append(m.Answer, answers...)
+			m.Rcode = rcode
+			customHandled = true
+			source = DNS_SOURCE_CUSTOM
+
+			// CNAME to a name we do not know
+			if chase != "" {
+				chaseMsg := new(dns.Msg)
+				chaseMsg.SetQuestion(chase, q.Qtype)
+				chaseResponse, _, err := forwardDNS(chaseMsg, policy)
+				if err != nil {
+					utils.Error("Failed to resolve CNAME target " + chase, err)
+				} else {
+					m.Answer = append(m.Answer, chaseResponse.Answer...)
+					m.Rcode = chaseResponse.Rcode
 				}
 			}
 		}
@@ -65,11 +87,14 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 		for _, q := range r.Question {
 			utils.Debug("DNS Question " + q.Name)
 			for _, hostname := range hostnames {
-				if strings.HasSuffix(q.Name, hostname + ".") && q.Qtype == dns.TypeA {
+				name := strings.ToLower(q.Name)
+				hostname = strings.ToLower(hostname)
+				if (name == hostname + "." || strings.HasSuffix(name, "." + hostname + ".")) && q.Qtype == dns.TypeA {
 					utils.Debug("DNS Overwrite " + hostname + " with 192.168.201.1")
 					rr, _ := dns.NewRR(q.Name + " A 192.168.201.1")
 					m.Answer = append(m.Answer, rr)
 					customHandled = true
+					source = DNS_SOURCE_LOCAL
 				}
 			}
 		}
@@ -78,35 +103,55 @@ func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	if !customHandled {
 		// Block blacklisted domains
 		for _, q := range r.Question {
-			noDot := strings.TrimSuffix(q.Name, ".")
-			if DNSBlacklist[noDot] {
-				if q.Qtype == dns.TypeA {
-					utils.Debug("DNS Block " + noDot)
-					rr, _ := dns.NewRR(q.Name + " A 0.0.0.0")
-					m.Answer = append(m.Answer, rr)
-				}
-				
+			if isDNSBlocked(q.Name, policy) {
+				utils.Debug("DNS Block " + q.Name)
+				blockDNSAnswer(m, q)
+
 				customHandled = true
+				source = DNS_SOURCE_BLOCKED
 			}
 		}
 	}
 
 	// If not custom handled, use external DNS
 	if !customHandled {
-		client := new(dns.Client)
-		externalResponse, time, err := externalLookup(client, r, DNSFallback)
+		externalResponse, fromCache, err := forwardDNS(r, policy)
+		cached = fromCache
 		if err != nil {
 			utils.Error("Failed to forward query:", err)
-			return
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			m = externalResponse
 		}
-		utils.Debug("DNS Forwarded DNS query to "+DNSFallback+" in " + time.String())
-		
-		externalResponse.Id = r.Id
+	}
 
-		m = externalResponse
+	// the client retries over TCP
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(dnsUDPSize(r))
 	}
 
 	w.WriteMsg(m)
+
+	if len(r.Question) > 0 {
+		entry := DNSQueryLogEntry{
+			Date: start,
+			ClientIP: clientIP,
+			Policy: policy.name(),
+			Name: strings.ToLower(strings.TrimSuffix(r.Question[0].Name, ".")),
+			Type: dns.TypeToString[r.Question[0].Qtype],
+			Source: source,
+			Cached: cached,
+			Rcode: dns.RcodeToString[m.Rcode],
+			Duration: float64(time.Since(start).Microseconds()) / 1000,
+		}
+
+		if deviceFound {
+			entry.Device = device.DeviceName
+			entry.User = device.Nickname
+		}
+
+		go recordDNSQuery(entry)
+	}
 }
 
 func isDomain(domain string) bool {
@@ -117,22 +162,33 @@ func isDomain(domain string) bool {
 	return false
 }
 
-func loadRawBlockList(DNSBlacklistRaw string) {
+// parseRawBlockList reads domain lists, hosts files and ||example.com^ rules
+func parseRawBlockList(DNSBlacklistRaw string) map[string]bool {
+	DNSBlacklist := map[string]bool{}
+
 	DNSBlacklistArray := strings.Split(string(DNSBlacklistRaw), "\n")
 	for _, domain := range DNSBlacklistArray {
-		if domain != "" && !strings.HasPrefix(domain, "#") {
-			splitDomain := strings.Split(domain, " ")
-			if len(splitDomain) == 1 && isDomain(splitDomain[0]) {
+		if comment := strings.Index(domain, "#"); comment >= 0 {
+			domain = domain[:comment]
+		}
+		domain = strings.ToLower(domain)
+
+		splitDomain := strings.Fields(domain)
+		if len(splitDomain) == 1 {
+			noRule := strings.TrimSuffix(strings.TrimPrefix(splitDomain[0], "||"), "^")
+			if isDomain(noRule) {
+				DNSBlacklist[strings.TrimSuffix(noRule, ".")] = true
+			}
+		} else if len(splitDomain) == 2 {
+			if isDomain(splitDomain[0]) {
 				DNSBlacklist[splitDomain[0]] = true
-			} else if len(splitDomain) == 2 {
-				if isDomain(splitDomain[0]) {
-					DNSBlacklist[splitDomain[0]] = true
-				} else if isDomain(splitDomain[1]) {
-					DNSBlacklist[splitDomain[1]] = true
-				}
+			} else if isDomain(splitDomain[1]) {
+				DNSBlacklist[splitDomain[1]] = true
 			}
 		}
 	}
+
+	return DNSBlacklist
 }
 
 func InitDNS() {
@@ -144,63 +200,38 @@ func InitDNS() {
 	
 	config := utils.GetMainConfig()
 	DNSPort := config.ConstellationConfig.DNSPort
-	DNSBlockBlacklist := config.ConstellationConfig.DNSBlockBlacklist
 
 	if DNSPort == "" {
 		DNSPort = "53"
 	}
 
-	if DNSBlockBlacklist {
-		DNSBlacklist = map[string]bool{}
-		blacklistPath := utils.CONFIGFOLDER + "dns-blacklist.txt"
-
-		utils.Log("Loading DNS blacklist from " + blacklistPath)
-
-		fileExist := utils.FileExists(blacklistPath)
-		if fileExist {
-			DNSBlacklistRaw, err := ioutil.ReadFile(blacklistPath)
-			if err != nil {
-				utils.Error("Failed to load DNS blacklist", err)
-			} else {
-				loadRawBlockList(string(DNSBlacklistRaw))
-			}
-		} else {
-			utils.Log("No DNS blacklist found")
-		}
-
-		// download additional blocklists from config.DNSAdditionalBlocklists []string
-		for _, url := range config.ConstellationConfig.DNSAdditionalBlocklists {
-			utils.Log("Downloading DNS blacklist from " + url)
-			DNSBlacklistRaw, err := utils.DownloadFile(url)
-			if err != nil {
-				utils.Error("Failed to download DNS blacklist", err)
-			} else {
-				loadRawBlockList(DNSBlacklistRaw)
-			}
-		}
-		
-		utils.Log("Loaded " + strconv.Itoa(len(DNSBlacklist)) + " domains")
-	}
+	// the lists kept from the last download are used until the new ones are checked,
+	// then the CRON refreshes them every DNSBlocklistsRefreshHours
+	go RefreshDNSBlocklists(false)
 
 	if(!config.ConstellationConfig.DNSDisabled) {
-		go (func() {
-			dns.HandleFunc(".", handleDNSRequest)
-			server := &dns.Server{Addr: "192.168.201.1:" + DNSPort, Net: "udp"}
+		dns.HandleFunc(".", handleDNSRequest)
 
-			utils.Log("Starting DNS server on :" + DNSPort)
-			var err error
+		// TCP for the responses too large for UDP
+		for _, network := range []string{"udp", "tcp"} {
+			go (func(network string) {
+				server := &dns.Server{Addr: "192.168.201.1:" + DNSPort, Net: network}
+
+				utils.Log("Starting DNS server on :" + DNSPort + "/" + network)
+				var err error
 
-			err = server.ListenAndServe();
-			retries := 0
-			for err != nil && retries < 4 {
-				time.Sleep(time.Duration(2 * (retries + 1)) * time.Second)
 				err = server.ListenAndServe();
-				retries++
-				utils.Debug("Retrying to start DNS server")
-			}
-			if err != nil {
-				utils.Error("Failed to start DNS server", err)
-			}
-		})()
+				retries := 0
+				for err != nil && retries < 4 {
+					time.Sleep(time.Duration(2 * (retries + 1)) * time.Second)
+					err = server.ListenAndServe();
+					retries++
+					utils.Debug("Retrying to start DNS server")
+				}
+				if err != nil {
+					utils.Error("Failed to start DNS server", err)
+				}
+			})(network)
+		}
 	}
 }
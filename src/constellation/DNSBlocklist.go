@@ -0,0 +1,588 @@
+package constellation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	dnsBlocklistsDefaultRefresh = 24 * time.Hour
+	dnsBlocklistTimeout         = 2 * time.Minute
+	dnsBlockTTL                 = 60
+)
+
+type DNSBlocklistStatus struct {
+	URL          string `json:"url"`
+	Enabled      bool   `json:"enabled"`
+	Domains      int    `json:"domains"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+	// last time the list was downloaded or found unchanged
+	CheckedAt time.Time `json:"checkedAt"`
+	// last time the content changed
+	UpdatedAt time.Time `json:"updatedAt"`
+	Error     string    `json:"error"`
+	// the policies using the list, without the global lists
+	Policies []string `json:"policies"`
+}
+
+type dnsBlocklist struct {
+	DNSBlocklistStatus
+	domains map[string]bool
+}
+
+var dnsBlocklists = struct {
+	sync.RWMutex
+	lists map[string]*dnsBlocklist
+	// the domains of the enabled lists
+	domains map[string]bool
+	// the config the domains were merged for
+	sources  []string
+	disabled []string
+}{
+	lists:   map[string]*dnsBlocklist{},
+	domains: map[string]bool{},
+}
+
+// one refresh at a time, the CRON and the API can ask together
+var dnsBlocklistsRefreshLock sync.Mutex
+
+type dnsBlockRule struct {
+	name  string
+	glob  string
+	regex *regexp.Regexp
+}
+
+var dnsBlockRules = struct {
+	sync.Mutex
+	compiled bool
+	block    []string
+	allow    []string
+	// compiled
+	blockRules []dnsBlockRule
+	allowRules []dnsBlockRule
+}{}
+
+func dnsLocalBlocklist() string {
+	return utils.CONFIGFOLDER + "dns-blacklist.txt"
+}
+
+// dnsBlocklistSources returns the local file first, then the downloaded lists
+func dnsBlocklistSources(config utils.ConstellationConfig) []string {
+	return append([]string{dnsLocalBlocklist()}, config.DNSAdditionalBlocklists...)
+}
+
+// dnsAllBlocklistSources adds the lists of the policies to the global ones
+func dnsAllBlocklistSources(config utils.ConstellationConfig) []string {
+	sources := dnsBlocklistSources(config)
+	for _, policy := range config.DNSPolicies {
+		for _, url := range policy.Blocklists {
+			found := false
+			for _, source := range sources {
+				if source == url {
+					found = true
+					break
+				}
+			}
+			if !found {
+				sources = append(sources, url)
+			}
+		}
+	}
+	return sources
+}
+
+func dnsBlocklistEnabled(config utils.ConstellationConfig, source string) bool {
+	for _, disabled := range config.DNSBlocklistsDisabled {
+		if disabled == source || (source == dnsLocalBlocklist() && disabled == "dns-blacklist.txt") {
+			return false
+		}
+	}
+	return true
+}
+
+func dnsBlocklistCachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return utils.CONFIGFOLDER + "dns-blocklists/" + hex.EncodeToString(sum[:8])
+}
+
+// loadCachedDNSBlocklist reads the copy kept from the last download, with its ETag
+func loadCachedDNSBlocklist(list *dnsBlocklist) error {
+	cachePath := dnsBlocklistCachePath(list.URL)
+
+	meta, err := ioutil.ReadFile(cachePath + ".json")
+	if err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(cachePath + ".txt")
+	if err != nil {
+		return err
+	}
+
+	status := DNSBlocklistStatus{}
+	if err := json.Unmarshal(meta, &status); err != nil {
+		return err
+	}
+
+	list.ETag = status.ETag
+	list.LastModified = status.LastModified
+	list.UpdatedAt = status.UpdatedAt
+	list.domains = parseRawBlockList(string(raw))
+	list.Domains = len(list.domains)
+
+	return nil
+}
+
+func saveCachedDNSBlocklist(list *dnsBlocklist, raw []byte) error {
+	cachePath := dnsBlocklistCachePath(list.URL)
+
+	if err := os.MkdirAll(path.Dir(cachePath), 0750); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(list.DNSBlocklistStatus)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(cachePath+".txt", raw, 0640); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(cachePath+".json", meta, 0640)
+}
+
+// downloadDNSBlocklist asks the list only if it changed since the last download
+func downloadDNSBlocklist(list *dnsBlocklist) ([]byte, bool, error) {
+	req, err := http.NewRequest("GET", list.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if list.domains != nil {
+		if list.ETag != "" {
+			req.Header.Set("If-None-Match", list.ETag)
+		}
+		if list.LastModified != "" {
+			req.Header.Set("If-Modified-Since", list.LastModified)
+		}
+	}
+
+	client := &http.Client{Timeout: dnsBlocklistTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, errors.New("unexpected status " + resp.Status)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	list.ETag = resp.Header.Get("ETag")
+	list.LastModified = resp.Header.Get("Last-Modified")
+
+	return raw, false, nil
+}
+
+func refreshDNSBlocklist(list *dnsBlocklist) {
+	// the local file is read every time
+	if list.URL == dnsLocalBlocklist() {
+		if !utils.FileExists(list.URL) {
+			list.domains = map[string]bool{}
+			list.Domains = 0
+			list.CheckedAt = time.Now()
+			return
+		}
+
+		raw, err := ioutil.ReadFile(list.URL)
+		if err != nil {
+			utils.Error("Failed to load DNS blacklist", err)
+			list.Error = err.Error()
+			return
+		}
+
+		list.domains = parseRawBlockList(string(raw))
+		list.Domains = len(list.domains)
+		list.CheckedAt = time.Now()
+		list.UpdatedAt = list.CheckedAt
+		list.Error = ""
+		return
+	}
+
+	// keep the previous download across restarts
+	if list.domains == nil {
+		if err := loadCachedDNSBlocklist(list); err == nil {
+			utils.Debug("DNS: loaded blocklist " + list.URL + " from the cache")
+		}
+	}
+
+	utils.Log("Downloading DNS blacklist from " + list.URL)
+
+	raw, notModified, err := downloadDNSBlocklist(list)
+	if err != nil {
+		utils.Error("Failed to download DNS blacklist "+list.URL, err)
+		list.Error = err.Error()
+		return
+	}
+
+	list.CheckedAt = time.Now()
+	list.Error = ""
+
+	if notModified {
+		utils.Debug("DNS: blocklist " + list.URL + " not modified")
+		return
+	}
+
+	list.domains = parseRawBlockList(string(raw))
+	list.Domains = len(list.domains)
+	list.UpdatedAt = list.CheckedAt
+
+	if err := saveCachedDNSBlocklist(list, raw); err != nil {
+		utils.Error("DNS: cannot cache the blocklist "+list.URL, err)
+	}
+}
+
+// mergeDNSBlocklists gathers the domains of the enabled global lists, dnsBlocklists must be locked
+func mergeDNSBlocklists(config utils.ConstellationConfig) {
+	sources := dnsAllBlocklistSources(config)
+
+	// forget the lists removed from the config
+	for url := range dnsBlocklists.lists {
+		found := false
+		for _, source := range sources {
+			if source == url {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(dnsBlocklists.lists, url)
+		}
+	}
+
+	for _, list := range dnsBlocklists.lists {
+		list.Enabled = dnsBlocklistEnabled(config, list.URL)
+	}
+
+	domains := map[string]bool{}
+	for _, source := range dnsBlocklistSources(config) {
+		list, ok := dnsBlocklists.lists[source]
+		if !ok || !list.Enabled {
+			continue
+		}
+
+		for domain := range list.domains {
+			domains[domain] = true
+		}
+	}
+
+	dnsBlocklists.domains = domains
+	dnsBlocklists.sources = sources
+	dnsBlocklists.disabled = append([]string{}, config.DNSBlocklistsDisabled...)
+}
+
+// RefreshDNSBlocklists downloads the lists older than DNSBlocklistsRefreshHours, or all of them when forced
+func RefreshDNSBlocklists(force bool) {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	if !NebulaStarted || config.DNSDisabled || !config.DNSBlockBlacklist {
+		return
+	}
+
+	dnsBlocklistsRefreshLock.Lock()
+	defer dnsBlocklistsRefreshLock.Unlock()
+
+	refresh := dnsBlocklistsDefaultRefresh
+	if config.DNSBlocklistsRefreshHours > 0 {
+		refresh = time.Duration(config.DNSBlocklistsRefreshHours) * time.Hour
+	}
+
+	refreshed := false
+	for _, source := range dnsAllBlocklistSources(config) {
+		if !dnsBlocklistEnabled(config, source) {
+			continue
+		}
+
+		// work on a copy, the queries keep using the current one
+		list := &dnsBlocklist{DNSBlocklistStatus: DNSBlocklistStatus{URL: source}}
+
+		dnsBlocklists.RLock()
+		current, ok := dnsBlocklists.lists[source]
+		if ok {
+			*list = *current
+		}
+		dnsBlocklists.RUnlock()
+
+		if ok && !force && list.domains != nil && time.Since(list.CheckedAt) < refresh {
+			continue
+		}
+
+		refreshDNSBlocklist(list)
+
+		dnsBlocklists.Lock()
+		dnsBlocklists.lists[source] = list
+		dnsBlocklists.Unlock()
+		refreshed = true
+	}
+
+	if !refreshed {
+		return
+	}
+
+	dnsBlocklists.Lock()
+	mergeDNSBlocklists(config)
+	total := len(dnsBlocklists.domains)
+	dnsBlocklists.Unlock()
+
+	utils.Log("Loaded " + strconv.Itoa(total) + " domains")
+}
+
+// getDNSBlocklists returns the domains of the enabled lists, merged again when the lists changed in the config
+func getDNSBlocklists() map[string]bool {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	dnsBlocklists.RLock()
+	changed := !reflect.DeepEqual(dnsBlocklists.sources, dnsAllBlocklistSources(config)) ||
+		!reflect.DeepEqual(dnsBlocklists.disabled, append([]string{}, config.DNSBlocklistsDisabled...))
+	domains := dnsBlocklists.domains
+	dnsBlocklists.RUnlock()
+
+	if !changed {
+		return domains
+	}
+
+	dnsBlocklists.Lock()
+	mergeDNSBlocklists(config)
+	domains = dnsBlocklists.domains
+	dnsBlocklists.Unlock()
+
+	// download the lists added or enabled
+	go RefreshDNSBlocklists(false)
+
+	return domains
+}
+
+// getDNSBlocklistsStatus lists every source of the config, downloaded or not
+func getDNSBlocklistsStatus() []DNSBlocklistStatus {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	dnsBlocklists.RLock()
+	defer dnsBlocklists.RUnlock()
+
+	global := dnsBlocklistSources(config)
+
+	statuses := []DNSBlocklistStatus{}
+	for i, source := range dnsAllBlocklistSources(config) {
+		status := DNSBlocklistStatus{URL: source}
+		if list, ok := dnsBlocklists.lists[source]; ok {
+			status = list.DNSBlocklistStatus
+		}
+		status.Enabled = dnsBlocklistEnabled(config, source)
+
+		status.Policies = []string{}
+		if i >= len(global) {
+			for _, policy := range config.DNSPolicies {
+				for _, url := range policy.Blocklists {
+					if url == source {
+						status.Policies = append(status.Policies, policy.Name)
+						break
+					}
+				}
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func parseDNSBlockRule(rule string) (dnsBlockRule, error) {
+	rule = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rule), "."))
+
+	if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		regex, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return dnsBlockRule{}, err
+		}
+		return dnsBlockRule{regex: regex}, nil
+	}
+
+	if strings.ContainsAny(rule, "*?[") {
+		if _, err := path.Match(rule, ""); err != nil {
+			return dnsBlockRule{}, err
+		}
+		return dnsBlockRule{glob: rule}, nil
+	}
+
+	if rule == "" {
+		return dnsBlockRule{}, errors.New("empty rule")
+	}
+
+	return dnsBlockRule{name: rule}, nil
+}
+
+func (rule dnsBlockRule) matches(name string) bool {
+	if rule.regex != nil {
+		return rule.regex.MatchString(name)
+	}
+	if rule.glob != "" {
+		matched, _ := path.Match(rule.glob, name)
+		return matched
+	}
+	return name == rule.name || strings.HasSuffix(name, "."+rule.name)
+}
+
+func compileDNSBlockRules(rules []string) []dnsBlockRule {
+	compiled := []dnsBlockRule{}
+	for _, rule := range rules {
+		parsed, err := parseDNSBlockRule(rule)
+		if err != nil {
+			utils.Error("DNS: ignoring block rule "+rule, err)
+			continue
+		}
+		compiled = append(compiled, parsed)
+	}
+	return compiled
+}
+
+// getDNSBlockRules compiles the block rules and the allowlist again when the config changed
+func getDNSBlockRules() ([]dnsBlockRule, []dnsBlockRule) {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	dnsBlockRules.Lock()
+	defer dnsBlockRules.Unlock()
+
+	if dnsBlockRules.compiled &&
+		reflect.DeepEqual(config.DNSBlockRules, dnsBlockRules.block) &&
+		reflect.DeepEqual(config.DNSAllowlist, dnsBlockRules.allow) {
+		return dnsBlockRules.blockRules, dnsBlockRules.allowRules
+	}
+
+	dnsBlockRules.block = append([]string(nil), config.DNSBlockRules...)
+	dnsBlockRules.allow = append([]string(nil), config.DNSAllowlist...)
+	dnsBlockRules.blockRules = compileDNSBlockRules(config.DNSBlockRules)
+	dnsBlockRules.allowRules = compileDNSBlockRules(config.DNSAllowlist)
+	dnsBlockRules.compiled = true
+
+	return dnsBlockRules.blockRules, dnsBlockRules.allowRules
+}
+
+func matchDNSBlockRules(rules []dnsBlockRule, name string) bool {
+	for _, rule := range rules {
+		if rule.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDNSBlocklists looks for the name and its parent domains in the lists
+func matchDNSBlocklists(domains map[string]bool, name string) bool {
+	for {
+		if domains[name] {
+			return true
+		}
+
+		dot := strings.Index(name, ".")
+		if dot < 0 {
+			return false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// matchDNSPolicyBlocklists looks for the name in the enabled lists of the policy
+func matchDNSPolicyBlocklists(policy *dnsPolicy, name string) bool {
+	dnsBlocklists.RLock()
+	defer dnsBlocklists.RUnlock()
+
+	for _, url := range policy.config.Blocklists {
+		if list, ok := dnsBlocklists.lists[url]; ok && list.Enabled && matchDNSBlocklists(list.domains, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDNSBlocked tells if the name is blocked by the lists or the rules, global or of
+// the policy, and not allowed
+func isDNSBlocked(name string, policy *dnsPolicy) bool {
+	if !utils.GetMainConfig().ConstellationConfig.DNSBlockBlacklist {
+		return false
+	}
+
+	if policy != nil && policy.config.BlockingDisabled {
+		return false
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	blockRules, allowRules := getDNSBlockRules()
+
+	if matchDNSBlockRules(allowRules, name) {
+		return false
+	}
+
+	if policy != nil && matchDNSBlockRules(policy.allowRules, name) {
+		return false
+	}
+
+	if matchDNSBlocklists(getDNSBlocklists(), name) || matchDNSBlockRules(blockRules, name) {
+		return true
+	}
+
+	return policy != nil && (matchDNSBlockRules(policy.blockRules, name) || matchDNSPolicyBlocklists(policy, name))
+}
+
+// blockDNSAnswer answers the question of a blocked name following DNSBlockingMode
+func blockDNSAnswer(m *dns.Msg, q dns.Question) {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	if config.DNSBlockingMode == "nxdomain" {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+
+	ipv4, ipv6 := "0.0.0.0", "::"
+	if config.DNSBlockingMode == "custom" {
+		ipv4, ipv6 = config.DNSBlockingIP, config.DNSBlockingIPv6
+	}
+
+	header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: dnsBlockTTL}
+
+	// the other types get an empty answer
+	switch {
+	case q.Qtype == dns.TypeA && ipv4 != "":
+		m.Answer = append(m.Answer, &dns.A{Hdr: header, A: net.ParseIP(ipv4)})
+	case q.Qtype == dns.TypeAAAA && ipv6 != "":
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: header, AAAA: net.ParseIP(ipv6)})
+	}
+}
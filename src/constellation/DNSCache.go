@@ -0,0 +1,222 @@
+package constellation
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	dnsCacheDefaultSize = 10000
+	dnsCacheMaxTTL      = 24 * time.Hour
+	// negative answers without SOA
+	dnsCacheNegativeTTL = 60 * time.Second
+)
+
+type dnsCacheEntry struct {
+	key      string
+	msg      *dns.Msg
+	storedAt time.Time
+	ttl      time.Duration
+	element  *list.Element
+}
+
+var dnsCache = struct {
+	sync.Mutex
+	entries map[string]*dnsCacheEntry
+	lru     *list.List
+}{
+	entries: map[string]*dnsCacheEntry{},
+	lru:     list.New(),
+}
+
+// dnsCacheKey keeps the answers of the policies with their own upstreams apart with the scope
+func dnsCacheKey(r *dns.Msg, scope string) (string, bool) {
+	if len(r.Question) != 1 {
+		return "", false
+	}
+
+	q := r.Question[0]
+	key := scope + "/" + strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass))
+	// the client validates itself
+	if r.CheckingDisabled {
+		key += "/cd"
+	}
+	return key, true
+}
+
+// dnsResponseTTL is the lowest TTL of the response, or the SOA minimum of negative answers
+func dnsResponseTTL(m *dns.Msg) (time.Duration, bool) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	if m.Rcode == dns.RcodeNameError || len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Minttl
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+				return time.Duration(ttl) * time.Second, ttl > 0
+			}
+		}
+		return dnsCacheNegativeTTL, true
+	}
+
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+
+	duration := time.Duration(ttl) * time.Second
+	if duration > dnsCacheMaxTTL {
+		duration = dnsCacheMaxTTL
+	}
+
+	return duration, duration > 0
+}
+
+func getDNSCache(r *dns.Msg, scope string) *dns.Msg {
+	if utils.GetMainConfig().ConstellationConfig.DNSCacheDisabled {
+		return nil
+	}
+
+	key, ok := dnsCacheKey(r, scope)
+	if !ok {
+		return nil
+	}
+
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+
+	entry, ok := dnsCache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	elapsed := time.Since(entry.storedAt)
+	if elapsed >= entry.ttl {
+		dnsCache.lru.Remove(entry.element)
+		delete(dnsCache.entries, key)
+		return nil
+	}
+
+	dnsCache.lru.MoveToFront(entry.element)
+
+	m := entry.msg.Copy()
+	m.Id = r.Id
+	m.Question = append([]dns.Question{}, r.Question...)
+
+	// the time left, as a resolver would tell
+	seconds := uint32(elapsed / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > seconds {
+				rr.Header().Ttl -= seconds
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return m
+}
+
+func setDNSCache(r *dns.Msg, scope string, m *dns.Msg) {
+	config := utils.GetMainConfig().ConstellationConfig
+	if config.DNSCacheDisabled {
+		return
+	}
+
+	key, ok := dnsCacheKey(r, scope)
+	if !ok {
+		return
+	}
+
+	ttl, ok := dnsResponseTTL(m)
+	if !ok {
+		return
+	}
+
+	maxSize := config.DNSCacheSize
+	if maxSize <= 0 {
+		maxSize = dnsCacheDefaultSize
+	}
+
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+
+	if previous, ok := dnsCache.entries[key]; ok {
+		dnsCache.lru.Remove(previous.element)
+	}
+
+	entry := &dnsCacheEntry{
+		key:      key,
+		msg:      m.Copy(),
+		storedAt: time.Now(),
+		ttl:      ttl,
+	}
+	entry.element = dnsCache.lru.PushFront(entry)
+	dnsCache.entries[key] = entry
+
+	for dnsCache.lru.Len() > maxSize {
+		oldest := dnsCache.lru.Back().Value.(*dnsCacheEntry)
+		dnsCache.lru.Remove(oldest.element)
+		delete(dnsCache.entries, oldest.key)
+	}
+}
+
+func flushDNSCache() {
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+
+	dnsCache.entries = map[string]*dnsCacheEntry{}
+	dnsCache.lru = list.New()
+}
+
+// forwardDNS answers from the cache or the upstreams of the policy, and tells if it was cached
+func forwardDNS(r *dns.Msg, policy *dnsPolicy) (*dns.Msg, bool, error) {
+	upstreams := getDNSUpstreams()
+	scope := ""
+	if policy != nil && policy.upstreams != nil {
+		upstreams = policy.upstreams
+		scope = policy.name()
+	}
+
+	if cached := getDNSCache(r, scope); cached != nil {
+		utils.Debug("DNS cache hit for " + r.Question[0].Name)
+		return cached, true, nil
+	}
+
+	start := time.Now()
+
+	response, err := upstreams.exchange(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	utils.Debug("DNS Forwarded DNS query in " + time.Since(start).String())
+
+	setDNSCache(r, scope, response)
+
+	return response, false, nil
+}
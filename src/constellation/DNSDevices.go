@@ -0,0 +1,95 @@
+package constellation
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+// how long the devices are kept before being read again from the database
+const dnsDevicesRefresh = time.Minute
+
+var dnsDevices struct {
+	sync.Mutex
+	byIP     map[string]utils.ConstellationDevice
+	loadedAt time.Time
+}
+
+func loadDNSDevices() (map[string]utils.ConstellationDevice, error) {
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "devices")
+	defer closeDb()
+	if errCo != nil {
+		return nil, errCo
+	}
+
+	var devices []utils.ConstellationDevice
+
+	cursor, err := c.Find(nil, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(nil)
+
+	if err = cursor.All(nil, &devices); err != nil {
+		return nil, err
+	}
+
+	byIP := map[string]utils.ConstellationDevice{}
+	for _, device := range devices {
+		byIP[cleanIp(device.IP)] = device
+	}
+
+	return byIP, nil
+}
+
+// getDNSClientDevice returns the Constellation device using the IP, if any
+func getDNSClientDevice(ip string) (utils.ConstellationDevice, bool) {
+	dnsDevices.Lock()
+	defer dnsDevices.Unlock()
+
+	if dnsDevices.byIP == nil || time.Since(dnsDevices.loadedAt) > dnsDevicesRefresh {
+		byIP, err := loadDNSDevices()
+		if err != nil {
+			utils.Error("DNS: cannot load the Constellation devices", err)
+			if dnsDevices.byIP == nil {
+				dnsDevices.byIP = map[string]utils.ConstellationDevice{}
+			}
+		} else {
+			dnsDevices.byIP = byIP
+		}
+		// do not retry on every query when the database fails
+		dnsDevices.loadedAt = time.Now()
+	}
+
+	device, ok := dnsDevices.byIP[ip]
+	return device, ok
+}
+
+// invalidateDNSDevices reads the devices again on the next query, after they changed
+func invalidateDNSDevices() {
+	dnsDevices.Lock()
+	defer dnsDevices.Unlock()
+
+	dnsDevices.loadedAt = time.Time{}
+}
+
+func dnsClientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
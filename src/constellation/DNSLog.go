@@ -0,0 +1,350 @@
+package constellation
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/madejackson/cosmos-server/src/metrics"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	DNS_SOURCE_LOCAL    = "local"
+	DNS_SOURCE_CUSTOM   = "custom"
+	DNS_SOURCE_BLOCKED  = "blocked"
+	DNS_SOURCE_UPSTREAM = "upstream"
+)
+
+const (
+	dnsRecentQueriesSize = 1000
+	// distinct domains counted, a new domain replaces the rarest one
+	dnsStatsMaxDomains = 10000
+	dnsStatsTop        = 20
+	// how often the top blocked domains pushed to the metrics are refreshed
+	dnsTopBlockedRefresh = 30 * time.Second
+)
+
+type DNSQueryLogEntry struct {
+	Date     time.Time `json:"date" bson:"date"`
+	ClientIP string    `json:"clientIP" bson:"clientIP"`
+	Device   string    `json:"device" bson:"device"`
+	User     string    `json:"user" bson:"user"`
+	Policy   string    `json:"policy" bson:"policy"`
+	Name     string    `json:"name" bson:"name"`
+	Type     string    `json:"type" bson:"type"`
+	Source   string    `json:"source" bson:"source"`
+	Cached   bool      `json:"cached" bson:"cached"`
+	Rcode    string    `json:"rcode" bson:"rcode"`
+	// in milliseconds
+	Duration float64 `json:"duration" bson:"duration"`
+}
+
+type DNSClientStats struct {
+	ClientIP string    `json:"clientIP"`
+	Device   string    `json:"device"`
+	User     string    `json:"user"`
+	Queries  int64     `json:"queries"`
+	Blocked  int64     `json:"blocked"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type DNSDomainCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type DNSStats struct {
+	Since      time.Time        `json:"since"`
+	Queries    int64            `json:"queries"`
+	Blocked    int64            `json:"blocked"`
+	Cached     int64            `json:"cached"`
+	Sources    map[string]int64 `json:"sources"`
+	Clients    []DNSClientStats `json:"clients"`
+	TopDomains []DNSDomainCount `json:"topDomains"`
+	TopBlocked []DNSDomainCount `json:"topBlocked"`
+}
+
+// the statistics are counted in memory since the start of the server
+var dnsStats = struct {
+	sync.Mutex
+	since          time.Time
+	queries        int64
+	blocked        int64
+	cached         int64
+	sources        map[string]int64
+	clients        map[string]*DNSClientStats
+	domains        *dnsDomainCounter
+	blockedDomains *dnsDomainCounter
+	// the top blocked domains, pushed to the metrics
+	topBlocked   map[string]bool
+	topBlockedAt time.Time
+}{
+	since:          time.Now(),
+	sources:        map[string]int64{},
+	clients:        map[string]*DNSClientStats{},
+	domains:        newDNSDomainCounter(dnsStatsMaxDomains),
+	blockedDomains: newDNSDomainCounter(dnsStatsMaxDomains),
+	topBlocked:     map[string]bool{},
+}
+
+var dnsRecentQueries = struct {
+	sync.Mutex
+	entries []DNSQueryLogEntry
+	next    int
+}{}
+
+type dnsDomainCount struct {
+	name  string
+	count int64
+	index int
+}
+
+// dnsDomainHeap is a min-heap of the counts, the rarest domain first
+type dnsDomainHeap []*dnsDomainCount
+
+func (h dnsDomainHeap) Len() int           { return len(h) }
+func (h dnsDomainHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h dnsDomainHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *dnsDomainHeap) Push(x interface{}) {
+	domain := x.(*dnsDomainCount)
+	domain.index = len(*h)
+	*h = append(*h, domain)
+}
+
+func (h *dnsDomainHeap) Pop() interface{} {
+	old := *h
+	domain := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return domain
+}
+
+// dnsDomainCounter counts at most size domains with the space-saving algorithm: when full,
+// a new domain takes the place of the rarest one and its count plus one, so the frequent
+// domains are kept and their counts are never under-estimated
+type dnsDomainCounter struct {
+	size    int
+	heap    dnsDomainHeap
+	domains map[string]*dnsDomainCount
+}
+
+func newDNSDomainCounter(size int) *dnsDomainCounter {
+	return &dnsDomainCounter{
+		size:    size,
+		heap:    dnsDomainHeap{},
+		domains: map[string]*dnsDomainCount{},
+	}
+}
+
+func (counter *dnsDomainCounter) increment(name string) {
+	if domain, ok := counter.domains[name]; ok {
+		domain.count++
+		heap.Fix(&counter.heap, domain.index)
+		return
+	}
+
+	if len(counter.heap) < counter.size {
+		domain := &dnsDomainCount{name: name, count: 1}
+		counter.domains[name] = domain
+		heap.Push(&counter.heap, domain)
+		return
+	}
+
+	rarest := counter.heap[0]
+	delete(counter.domains, rarest.name)
+	rarest.name = name
+	rarest.count++
+	counter.domains[name] = rarest
+	heap.Fix(&counter.heap, rarest.index)
+}
+
+func topDNSDomains(counter *dnsDomainCounter) []DNSDomainCount {
+	top := []DNSDomainCount{}
+	for _, domain := range counter.heap {
+		top = append(top, DNSDomainCount{Name: domain.name, Count: domain.count})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Name < top[j].Name
+		}
+		return top[i].Count > top[j].Count
+	})
+
+	if len(top) > dnsStatsTop {
+		top = top[:dnsStatsTop]
+	}
+	return top
+}
+
+func pushDNSMetric(key string, label string) {
+	metrics.PushSetMetric(key, 1, metrics.DataDef{
+		Max:          0,
+		Period:       time.Second * 30,
+		Label:        label,
+		AggloType:    "sum",
+		SetOperation: "sum",
+	})
+}
+
+// isTopBlockedDNSDomain tells if the domain is one of the top blocked ones, the lock must be held
+func isTopBlockedDNSDomain(name string) bool {
+	if time.Since(dnsStats.topBlockedAt) > dnsTopBlockedRefresh {
+		dnsStats.topBlocked = map[string]bool{}
+		for _, domain := range topDNSDomains(dnsStats.blockedDomains) {
+			dnsStats.topBlocked[domain.Name] = true
+		}
+		dnsStats.topBlockedAt = time.Now()
+	}
+
+	return dnsStats.topBlocked[name]
+}
+
+func recordDNSQuery(entry DNSQueryLogEntry) {
+	blocked := entry.Source == DNS_SOURCE_BLOCKED
+	topBlocked := false
+
+	dnsStats.Lock()
+	dnsStats.queries++
+	dnsStats.sources[entry.Source]++
+	if blocked {
+		dnsStats.blocked++
+		dnsStats.blockedDomains.increment(entry.Name)
+		topBlocked = isTopBlockedDNSDomain(entry.Name)
+	}
+	if entry.Cached {
+		dnsStats.cached++
+	}
+	dnsStats.domains.increment(entry.Name)
+
+	client, ok := dnsStats.clients[entry.ClientIP]
+	if !ok {
+		client = &DNSClientStats{ClientIP: entry.ClientIP}
+		dnsStats.clients[entry.ClientIP] = client
+	}
+	client.Device = entry.Device
+	client.User = entry.User
+	client.Queries++
+	if blocked {
+		client.Blocked++
+	}
+	client.LastSeen = entry.Date
+	dnsStats.Unlock()
+
+	dnsRecentQueries.Lock()
+	if len(dnsRecentQueries.entries) < dnsRecentQueriesSize {
+		dnsRecentQueries.entries = append(dnsRecentQueries.entries, entry)
+	} else {
+		dnsRecentQueries.entries[dnsRecentQueries.next] = entry
+	}
+	dnsRecentQueries.next = (dnsRecentQueries.next + 1) % dnsRecentQueriesSize
+	dnsRecentQueries.Unlock()
+
+	config := utils.GetMainConfig()
+
+	if !config.MonitoringDisabled {
+		pushDNSMetric("dns.queries", "DNS Queries")
+		if blocked {
+			pushDNSMetric("dns.blocked", "DNS Blocked")
+		}
+		if topBlocked {
+			pushDNSMetric("dns.blocked.domain."+entry.Name, "DNS Blocked "+entry.Name)
+		}
+		if entry.Cached {
+			pushDNSMetric("dns.cached", "DNS Cached")
+		}
+	}
+
+	if config.ConstellationConfig.DNSQueryLog {
+		utils.BufferedDBWrite("dnslogs", map[string]interface{}{
+			"date":     entry.Date,
+			"clientIP": entry.ClientIP,
+			"device":   entry.Device,
+			"user":     entry.User,
+			"policy":   entry.Policy,
+			"name":     entry.Name,
+			"type":     entry.Type,
+			"source":   entry.Source,
+			"cached":   entry.Cached,
+			"rcode":    entry.Rcode,
+			"duration": entry.Duration,
+		})
+	}
+}
+
+// recentDNSQueries returns the queries kept in memory, newest first
+func recentDNSQueries() []DNSQueryLogEntry {
+	dnsRecentQueries.Lock()
+	defer dnsRecentQueries.Unlock()
+
+	size := len(dnsRecentQueries.entries)
+	entries := make([]DNSQueryLogEntry, 0, size)
+	for i := 1; i <= size; i++ {
+		entries = append(entries, dnsRecentQueries.entries[(dnsRecentQueries.next-i+size)%size])
+	}
+	return entries
+}
+
+func getDNSStats() DNSStats {
+	dnsStats.Lock()
+	defer dnsStats.Unlock()
+
+	stats := DNSStats{
+		Since:      dnsStats.since,
+		Queries:    dnsStats.queries,
+		Blocked:    dnsStats.blocked,
+		Cached:     dnsStats.cached,
+		Sources:    map[string]int64{},
+		Clients:    []DNSClientStats{},
+		TopDomains: topDNSDomains(dnsStats.domains),
+		TopBlocked: topDNSDomains(dnsStats.blockedDomains),
+	}
+
+	for source, count := range dnsStats.sources {
+		stats.Sources[source] = count
+	}
+
+	for _, client := range dnsStats.clients {
+		stats.Clients = append(stats.Clients, *client)
+	}
+	sort.Slice(stats.Clients, func(i, j int) bool { return stats.Clients[i].Queries > stats.Clients[j].Queries })
+
+	return stats
+}
+
+// CleanupDNSLogs removes the queries older than DNSQueryLogRetentionDays from the database
+func CleanupDNSLogs() {
+	config := utils.GetMainConfig().ConstellationConfig
+	if !config.DNSQueryLog {
+		return
+	}
+
+	retention := config.DNSQueryLogRetentionDays
+	if retention == 0 {
+		retention = 7
+	}
+
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "dnslogs")
+	if errCo != nil {
+		utils.Error("DNSLog: Database Connect", errCo)
+		return
+	}
+
+	del, err := c.DeleteMany(context.Background(), bson.M{"date": bson.M{"$lt": time.Now().AddDate(0, 0, -retention)}})
+	if err != nil {
+		utils.Error("DNSLog: Database Cleanup", err)
+		return
+	}
+
+	utils.Log("Cleanup: dnslogs " + strconv.Itoa(int(del.DeletedCount)) + " objects deleted")
+}
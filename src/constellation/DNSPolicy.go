@@ -0,0 +1,117 @@
+package constellation
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type dnsPolicy struct {
+	config utils.ConstellationDNSPolicy
+	zone   map[string][]dnsRecord
+	// nil to use the global upstreams
+	upstreams  *dnsUpstreamGroup
+	blockRules []dnsBlockRule
+	allowRules []dnsBlockRule
+}
+
+var dnsPolicies struct {
+	sync.Mutex
+	config   []utils.ConstellationDNSPolicy
+	strategy string
+	byName   map[string]*dnsPolicy
+	byUser   map[string]*dnsPolicy
+}
+
+// getDNSPolicies compiles the policies again when the config changed
+func getDNSPolicies() (map[string]*dnsPolicy, map[string]*dnsPolicy) {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	dnsPolicies.Lock()
+	defer dnsPolicies.Unlock()
+
+	if dnsPolicies.byName != nil &&
+		reflect.DeepEqual(config.DNSPolicies, dnsPolicies.config) &&
+		config.DNSUpstreamStrategy == dnsPolicies.strategy {
+		return dnsPolicies.byName, dnsPolicies.byUser
+	}
+
+	// answers of the previous upstreams of the policies
+	if dnsPolicies.byName != nil {
+		flushDNSCache()
+	}
+
+	byName := map[string]*dnsPolicy{}
+	byUser := map[string]*dnsPolicy{}
+
+	for _, policyConfig := range config.DNSPolicies {
+		if _, ok := byName[policyConfig.Name]; ok {
+			utils.Warn("DNS: duplicate policy " + policyConfig.Name + ", only the first one is used")
+			continue
+		}
+
+		policy := &dnsPolicy{
+			config:     policyConfig,
+			zone:       compileCustomDNSZone(policyConfig.CustomDNSEntries),
+			blockRules: compileDNSBlockRules(policyConfig.BlockRules),
+			allowRules: compileDNSBlockRules(policyConfig.Allowlist),
+		}
+
+		if len(policyConfig.Upstreams) > 0 {
+			policy.upstreams = newDNSUpstreamGroup(policyConfig.Upstreams, config.DNSUpstreamStrategy)
+		}
+
+		byName[policyConfig.Name] = policy
+
+		// the first policy of a user wins
+		for _, nickname := range policyConfig.Users {
+			if _, ok := byUser[nickname]; !ok {
+				byUser[nickname] = policy
+			}
+		}
+	}
+
+	dnsPolicies.config = append([]utils.ConstellationDNSPolicy{}, config.DNSPolicies...)
+	dnsPolicies.strategy = config.DNSUpstreamStrategy
+	dnsPolicies.byName = byName
+	dnsPolicies.byUser = byUser
+
+	return byName, byUser
+}
+
+func dnsPolicyExists(name string) bool {
+	for _, policy := range utils.GetMainConfig().ConstellationConfig.DNSPolicies {
+		if policy.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getDNSClientPolicy returns the policy of the device, or of its user, nil for the global config
+func getDNSClientPolicy(device utils.ConstellationDevice) *dnsPolicy {
+	byName, byUser := getDNSPolicies()
+
+	if device.DNSPolicy != "" {
+		if policy, ok := byName[device.DNSPolicy]; ok {
+			return policy
+		}
+		utils.Debug("DNS: unknown policy " + device.DNSPolicy + " for " + device.DeviceName)
+	}
+
+	if device.Nickname != "" {
+		if policy, ok := byUser[device.Nickname]; ok {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+func (policy *dnsPolicy) name() string {
+	if policy == nil {
+		return ""
+	}
+	return policy.config.Name
+}
@@ -0,0 +1,263 @@
+package constellation
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const DNS_DEFAULT_TTL = 3600
+
+// CNAME chains longer than this are cut
+const dnsMaxCNAMEChain = 8
+
+type dnsRecord struct {
+	// lowercase FQDN, starting with *. for wildcards
+	name     string
+	nxdomain bool
+	rr       dns.RR
+}
+
+var customDNSZone struct {
+	sync.Mutex
+	entries []utils.ConstellationDNSEntry
+	records map[string][]dnsRecord
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(dns.Fqdn(strings.TrimSpace(name)))
+}
+
+func dnsTarget(value string) (string, error) {
+	target := normalizeDNSName(value)
+	if _, ok := dns.IsDomainName(target); !ok || target == "." {
+		return "", errors.New("invalid domain name " + value)
+	}
+	return target, nil
+}
+
+// parseDNSEntry turns a custom entry into a record, the Value being formatted as in a zone file:
+// an IP for A and AAAA, "10 mail.example.com" for MX, "priority weight port target" for SRV
+func parseDNSEntry(entry utils.ConstellationDNSEntry) (dnsRecord, error) {
+	recordType := strings.ToUpper(strings.TrimSpace(entry.Type))
+	if recordType == "" {
+		recordType = "A"
+	}
+
+	key := strings.TrimSpace(entry.Key)
+	value := strings.TrimSpace(entry.Value)
+
+	// PTR entries can be keyed by the IP itself
+	if recordType == "PTR" && net.ParseIP(key) != nil {
+		reverse, err := dns.ReverseAddr(key)
+		if err != nil {
+			return dnsRecord{}, err
+		}
+		key = reverse
+	}
+
+	name := normalizeDNSName(key)
+	if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok || name == "." || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return dnsRecord{}, errors.New("invalid name " + entry.Key)
+	}
+
+	record := dnsRecord{name: name}
+
+	if recordType == "NXDOMAIN" {
+		record.nxdomain = true
+		return record, nil
+	}
+
+	rrType, ok := dns.StringToType[recordType]
+	if !ok {
+		return dnsRecord{}, errors.New("unsupported record type " + entry.Type)
+	}
+
+	ttl := uint32(DNS_DEFAULT_TTL)
+	if entry.TTL > 0 {
+		ttl = uint32(entry.TTL)
+	}
+
+	header := dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET, Ttl: ttl}
+
+	switch rrType {
+	case dns.TypeA:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() == nil {
+			return dnsRecord{}, errors.New("invalid IPv4 " + value)
+		}
+		record.rr = &dns.A{Hdr: header, A: ip.To4()}
+	case dns.TypeAAAA:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() != nil {
+			return dnsRecord{}, errors.New("invalid IPv6 " + value)
+		}
+		record.rr = &dns.AAAA{Hdr: header, AAAA: ip}
+	case dns.TypeCNAME, dns.TypePTR:
+		target, err := dnsTarget(value)
+		if err != nil {
+			return dnsRecord{}, err
+		}
+		if rrType == dns.TypeCNAME {
+			record.rr = &dns.CNAME{Hdr: header, Target: target}
+		} else {
+			record.rr = &dns.PTR{Hdr: header, Ptr: target}
+		}
+	case dns.TypeTXT:
+		// strings are limited to 255 bytes
+		txt := []string{}
+		for len(value) > 255 {
+			txt = append(txt, value[:255])
+			value = value[255:]
+		}
+		record.rr = &dns.TXT{Hdr: header, Txt: append(txt, value)}
+	case dns.TypeMX:
+		fields := strings.Fields(value)
+		preference := 10
+		if len(fields) == 2 {
+			var err error
+			preference, err = strconv.Atoi(fields[0])
+			if err != nil || preference < 0 || preference > 65535 {
+				return dnsRecord{}, errors.New("invalid MX preference " + fields[0])
+			}
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return dnsRecord{}, errors.New("invalid MX value " + value)
+		}
+		target, err := dnsTarget(fields[0])
+		if err != nil {
+			return dnsRecord{}, err
+		}
+		record.rr = &dns.MX{Hdr: header, Preference: uint16(preference), Mx: target}
+	case dns.TypeSRV:
+		fields := strings.Fields(value)
+		if len(fields) != 4 {
+			return dnsRecord{}, errors.New("invalid SRV value " + value + ", expected: priority weight port target")
+		}
+		numbers := make([]uint16, 3)
+		for i := 0; i < 3; i++ {
+			number, err := strconv.Atoi(fields[i])
+			if err != nil || number < 0 || number > 65535 {
+				return dnsRecord{}, errors.New("invalid SRV value " + value)
+			}
+			numbers[i] = uint16(number)
+		}
+		target, err := dnsTarget(fields[3])
+		if err != nil {
+			return dnsRecord{}, err
+		}
+		record.rr = &dns.SRV{Hdr: header, Priority: numbers[0], Weight: numbers[1], Port: numbers[2], Target: target}
+	default:
+		return dnsRecord{}, errors.New("unsupported record type " + entry.Type)
+	}
+
+	return record, nil
+}
+
+func compileCustomDNSZone(entries []utils.ConstellationDNSEntry) map[string][]dnsRecord {
+	records := map[string][]dnsRecord{}
+	for _, entry := range entries {
+		record, err := parseDNSEntry(entry)
+		if err != nil {
+			utils.Error("DNS: ignoring custom entry "+entry.Type+" "+entry.Key, err)
+			continue
+		}
+		records[record.name] = append(records[record.name], record)
+	}
+	return records
+}
+
+// getCustomDNSZone compiles the custom entries again when the config changed
+func getCustomDNSZone() map[string][]dnsRecord {
+	entries := utils.GetMainConfig().ConstellationConfig.CustomDNSEntries
+
+	customDNSZone.Lock()
+	defer customDNSZone.Unlock()
+
+	if customDNSZone.records != nil && reflect.DeepEqual(entries, customDNSZone.entries) {
+		return customDNSZone.records
+	}
+
+	records := compileCustomDNSZone(entries)
+
+	customDNSZone.entries = append([]utils.ConstellationDNSEntry{}, entries...)
+	customDNSZone.records = records
+
+	return records
+}
+
+// lookupCustomDNS returns the records of the name, or of the closest wildcard above it
+func lookupCustomDNS(zone map[string][]dnsRecord, name string) []dnsRecord {
+	if records, ok := zone[name]; ok {
+		return records
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if records, ok := zone["*."+strings.Join(labels[i:], ".")+"."]; ok {
+			return records
+		}
+	}
+
+	return nil
+}
+
+// resolveCustomDNS answers from the custom entries of the zone, following CNAMEs. An
+// empty answer with RcodeSuccess is a NODATA, and the last CNAME target is returned
+// when it has to be resolved upstream
+func resolveCustomDNS(zone map[string][]dnsRecord, owner string, qtype uint16) ([]dns.RR, int, bool, string) {
+	answers := []dns.RR{}
+	name := normalizeDNSName(owner)
+
+	for depth := 0; depth < dnsMaxCNAMEChain; depth++ {
+		records := lookupCustomDNS(zone, name)
+		if records == nil {
+			if depth == 0 {
+				return nil, dns.RcodeSuccess, false, ""
+			}
+			return answers, dns.RcodeSuccess, true, name
+		}
+
+		var cname *dns.CNAME
+		found := false
+
+		for _, record := range records {
+			if record.nxdomain {
+				return answers, dns.RcodeNameError, true, ""
+			}
+
+			rrType := record.rr.Header().Rrtype
+			if rrType == qtype || qtype == dns.TypeANY {
+				rr := dns.Copy(record.rr)
+				// wildcards answer with the name asked
+				rr.Header().Name = owner
+				answers = append(answers, rr)
+				found = true
+			} else if rrType == dns.TypeCNAME {
+				cname = record.rr.(*dns.CNAME)
+			}
+		}
+
+		if found || cname == nil {
+			return answers, dns.RcodeSuccess, true, ""
+		}
+
+		rr := dns.Copy(cname)
+		rr.Header().Name = owner
+		answers = append(answers, rr)
+
+		owner = cname.Target
+		name = cname.Target
+	}
+
+	utils.Warn("DNS: CNAME chain too long for " + owner)
+	return answers, dns.RcodeSuccess, true, ""
+}
@@ -0,0 +1,327 @@
+package constellation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	dnsUpstreamTimeout = 3 * time.Second
+	// consecutive failures before an upstream is skipped for dnsUpstreamRetryAfter
+	dnsUpstreamMaxFailures = 3
+	dnsUpstreamRetryAfter  = 30 * time.Second
+)
+
+type dnsUpstream struct {
+	sync.Mutex
+	address    string
+	protocol   string
+	server     string
+	client     *dns.Client
+	httpClient *http.Client
+
+	failures  int
+	downUntil time.Time
+}
+
+type dnsUpstreamGroup struct {
+	upstreams []*dnsUpstream
+	parallel  bool
+}
+
+var dnsUpstreams struct {
+	sync.Mutex
+	config []string
+	group  *dnsUpstreamGroup
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// parseDNSUpstream accepts 8.8.8.8, udp://8.8.8.8:53, tcp://8.8.8.8,
+// tls://dns.google and https://dns.google/dns-query
+func parseDNSUpstream(address string) (*dnsUpstream, error) {
+	address = strings.TrimSpace(address)
+
+	protocol, server, ok := strings.Cut(address, "://")
+	if !ok {
+		protocol, server = "udp", address
+	}
+
+	upstream := &dnsUpstream{
+		address:  address,
+		protocol: protocol,
+	}
+
+	switch protocol {
+	case "udp", "tcp":
+		upstream.server = withDefaultPort(server, "53")
+		upstream.client = &dns.Client{Net: protocol, Timeout: dnsUpstreamTimeout}
+	case "tls":
+		upstream.server = withDefaultPort(server, "853")
+		hostname, _, _ := net.SplitHostPort(upstream.server)
+		upstream.client = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   dnsUpstreamTimeout,
+			TLSConfig: &tls.Config{ServerName: hostname, MinVersion: tls.VersionTLS12},
+		}
+	case "https":
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Host == "" {
+			return nil, errors.New("invalid DNS-over-HTTPS URL " + address)
+		}
+		upstream.server = address
+		upstream.httpClient = &http.Client{Timeout: dnsUpstreamTimeout}
+	default:
+		return nil, errors.New("unsupported DNS upstream protocol " + protocol)
+	}
+
+	if upstream.server == "" {
+		return nil, errors.New("invalid DNS upstream " + address)
+	}
+
+	return upstream, nil
+}
+
+func newDNSUpstreamGroup(addresses []string, strategy string) *dnsUpstreamGroup {
+	group := &dnsUpstreamGroup{
+		upstreams: []*dnsUpstream{},
+		parallel:  strategy == "parallel",
+	}
+
+	for _, address := range addresses {
+		upstream, err := parseDNSUpstream(address)
+		if err != nil {
+			utils.Error("DNS: ignoring upstream "+address, err)
+			continue
+		}
+		group.upstreams = append(group.upstreams, upstream)
+	}
+
+	return group
+}
+
+// getDNSUpstreams builds the upstreams again when the config changed
+func getDNSUpstreams() *dnsUpstreamGroup {
+	config := utils.GetMainConfig().ConstellationConfig
+
+	addresses := config.DNSUpstreams
+	if len(addresses) == 0 {
+		fallback := config.DNSFallback
+		if fallback == "" {
+			fallback = "8.8.8.8:53"
+		}
+		addresses = []string{fallback}
+	}
+
+	key := append([]string{config.DNSUpstreamStrategy}, addresses...)
+
+	dnsUpstreams.Lock()
+	defer dnsUpstreams.Unlock()
+
+	if dnsUpstreams.group != nil && reflect.DeepEqual(key, dnsUpstreams.config) {
+		return dnsUpstreams.group
+	}
+
+	group := newDNSUpstreamGroup(addresses, config.DNSUpstreamStrategy)
+
+	dnsUpstreams.config = key
+	dnsUpstreams.group = group
+
+	// answers of the previous upstreams
+	flushDNSCache()
+
+	return group
+}
+
+func (upstream *dnsUpstream) healthy(now time.Time) bool {
+	upstream.Lock()
+	defer upstream.Unlock()
+	return !now.Before(upstream.downUntil)
+}
+
+func (upstream *dnsUpstream) report(err error) {
+	upstream.Lock()
+	defer upstream.Unlock()
+
+	if err == nil {
+		upstream.failures = 0
+		upstream.downUntil = time.Time{}
+		return
+	}
+
+	upstream.failures++
+	if upstream.failures >= dnsUpstreamMaxFailures {
+		if upstream.failures == dnsUpstreamMaxFailures {
+			utils.Warn("DNS: upstream " + upstream.address + " is down: " + err.Error())
+		}
+		upstream.downUntil = time.Now().Add(dnsUpstreamRetryAfter)
+	}
+}
+
+func (upstream *dnsUpstream) exchange(r *dns.Msg) (*dns.Msg, error) {
+	query := r.Copy()
+	query.Id = dns.Id()
+
+	// Enable DNSSEC
+	query.SetEdns0(4096, true)
+	query.CheckingDisabled = false
+	query.MsgHdr.AuthenticatedData = true
+
+	if upstream.httpClient != nil {
+		// RFC 8484 asks for 0, so responses can be cached by HTTP caches
+		query.Id = 0
+		response, err := upstream.exchangeHTTPS(query)
+		if err != nil {
+			return nil, err
+		}
+		response.Id = r.Id
+		return response, nil
+	}
+
+	response, _, err := upstream.client.Exchange(query, upstream.server)
+	if err != nil {
+		return nil, err
+	}
+
+	// the full response over TCP
+	if response.Truncated && upstream.protocol == "udp" {
+		tcpClient := &dns.Client{Net: "tcp", Timeout: dnsUpstreamTimeout}
+		response, _, err = tcpClient.Exchange(query, upstream.server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response.Id = r.Id
+	return response, nil
+}
+
+func (upstream *dnsUpstream) exchangeHTTPS(query *dns.Msg) (*dns.Msg, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", upstream.server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := upstream.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DNS-over-HTTPS upstream returned " + resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// exchange asks the healthy upstreams, all of them when none is healthy.
+// A SERVFAIL is only returned when no upstream did better
+func (group *dnsUpstreamGroup) exchange(r *dns.Msg) (*dns.Msg, error) {
+	now := time.Now()
+
+	candidates := []*dnsUpstream{}
+	for _, upstream := range group.upstreams {
+		if upstream.healthy(now) {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = group.upstreams
+	}
+
+	if len(candidates) == 0 {
+		return nil, errors.New("no DNS upstream configured")
+	}
+
+	type result struct {
+		response *dns.Msg
+		err      error
+	}
+
+	ask := func(upstream *dnsUpstream) result {
+		response, err := upstream.exchange(r)
+		if err == nil && response.Rcode == dns.RcodeServerFailure {
+			upstream.report(errors.New("SERVFAIL"))
+		} else {
+			upstream.report(err)
+		}
+		return result{response, err}
+	}
+
+	var serverFailure *dns.Msg
+	var lastErr error
+
+	if group.parallel && len(candidates) > 1 {
+		results := make(chan result, len(candidates))
+		for _, upstream := range candidates {
+			go func(upstream *dnsUpstream) {
+				results <- ask(upstream)
+			}(upstream)
+		}
+
+		for range candidates {
+			res := <-results
+			if res.err != nil {
+				lastErr = res.err
+			} else if res.response.Rcode == dns.RcodeServerFailure {
+				serverFailure = res.response
+			} else {
+				return res.response, nil
+			}
+		}
+	} else {
+		for _, upstream := range candidates {
+			res := ask(upstream)
+			if res.err != nil {
+				utils.Debug("DNS: upstream " + upstream.address + " failed: " + res.err.Error())
+				lastErr = res.err
+			} else if res.response.Rcode == dns.RcodeServerFailure {
+				serverFailure = res.response
+			} else {
+				return res.response, nil
+			}
+		}
+	}
+
+	if serverFailure != nil {
+		return serverFailure, nil
+	}
+
+	return nil, lastErr
+}
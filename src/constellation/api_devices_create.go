@@ -15,6 +15,8 @@ type DeviceCreateRequestJSON struct {
 	
 	// for devices only
 	Nickname string `json:"nickname",validate:"max=32,alphanum",omitempty`
+	// admins only
+	DNSPolicy string `json:"dnsPolicy,omitempty"`
 	
 	// for lighthouse only
 	IsLighthouse bool `json:"isLighthouse",omitempty`
@@ -50,6 +52,20 @@ func DeviceCreate(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if request.DNSPolicy != "" && !utils.IsAdmin(req) {
+			utils.Error("DeviceCreation: Only admins can set the DNS policy", nil)
+			utils.HTTPError(w, "Device Creation Error: only admins can set the DNS policy",
+				http.StatusUnauthorized, "DC008")
+			return
+		}
+
+		if request.DNSPolicy != "" && !dnsPolicyExists(request.DNSPolicy) {
+			utils.Error("DeviceCreation: Unknown DNS policy " + request.DNSPolicy, nil)
+			utils.HTTPError(w, "Device Creation Error: unknown DNS policy",
+				http.StatusBadRequest, "DC009")
+			return
+		}
+
 		utils.Log("ConstellationDeviceCreation: Creating Device " + deviceName)
 
 		c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "devices")
@@ -106,6 +122,7 @@ func DeviceCreate(w http.ResponseWriter, req *http.Request) {
 				"Fingerprint": fingerprint,
 				"APIKey": APIKey,
 				"Blocked": false,
+				"DNSPolicy": request.DNSPolicy,
 			})
 
 			if err3 != nil {
@@ -115,6 +132,8 @@ func DeviceCreate(w http.ResponseWriter, req *http.Request) {
 				return 
 			} 
 
+			invalidateDNSDevices()
+
 			capki, err := getCApki()
 			if err != nil {
 				utils.Error("DeviceCreation: Error while reading ca.crt", err)
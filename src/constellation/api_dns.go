@@ -0,0 +1,321 @@
+package constellation
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type dnsLogFilter struct {
+	client string
+	device string
+	policy string
+	// part of the name
+	name   string
+	qtype  string
+	source string
+	from   time.Time
+	to     time.Time
+	limit  int
+}
+
+func parseDNSLogFilter(query map[string][]string) (dnsLogFilter, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	filter := dnsLogFilter{
+		client: get("client"),
+		device: get("device"),
+		policy: get("policy"),
+		name:   strings.ToLower(strings.TrimSuffix(get("name"), ".")),
+		qtype:  strings.ToUpper(get("type")),
+		source: get("source"),
+		limit:  100,
+	}
+
+	if from := get("from"); from != "" {
+		date, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, err
+		}
+		filter.from = date
+	}
+
+	if to := get("to"); to != "" {
+		date, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, err
+		}
+		filter.to = date
+	}
+
+	if limit := get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return filter, err
+		}
+		if value > 0 && value <= 1000 {
+			filter.limit = value
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter dnsLogFilter) bson() bson.M {
+	query := bson.M{}
+
+	if filter.client != "" {
+		query["clientIP"] = filter.client
+	}
+	if filter.device != "" {
+		query["device"] = filter.device
+	}
+	if filter.policy != "" {
+		query["policy"] = filter.policy
+	}
+	if filter.name != "" {
+		query["name"] = bson.M{"$regex": regexp.QuoteMeta(filter.name)}
+	}
+	if filter.qtype != "" {
+		query["type"] = filter.qtype
+	}
+	if filter.source != "" {
+		query["source"] = filter.source
+	}
+
+	if !filter.from.IsZero() || !filter.to.IsZero() {
+		date := bson.M{}
+		if !filter.from.IsZero() {
+			date["$gte"] = filter.from
+		}
+		if !filter.to.IsZero() {
+			date["$lte"] = filter.to
+		}
+		query["date"] = date
+	}
+
+	return query
+}
+
+func (filter dnsLogFilter) matches(entry DNSQueryLogEntry) bool {
+	if filter.client != "" && entry.ClientIP != filter.client {
+		return false
+	}
+	if filter.device != "" && entry.Device != filter.device {
+		return false
+	}
+	if filter.policy != "" && entry.Policy != filter.policy {
+		return false
+	}
+	if filter.name != "" && !strings.Contains(entry.Name, filter.name) {
+		return false
+	}
+	if filter.qtype != "" && entry.Type != filter.qtype {
+		return false
+	}
+	if filter.source != "" && entry.Source != filter.source {
+		return false
+	}
+	if !filter.from.IsZero() && entry.Date.Before(filter.from) {
+		return false
+	}
+	if !filter.to.IsZero() && entry.Date.After(filter.to) {
+		return false
+	}
+	return true
+}
+
+// API_GetDNSLogs lists the queries from the database when DNSQueryLog is on,
+// or from the last ones kept in memory
+func API_GetDNSLogs(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		filter, errF := parseDNSLogFilter(req.URL.Query())
+		if errF != nil {
+			utils.Error("DNSLogs: Invalid filter", errF)
+			utils.HTTPError(w, "Invalid filter: "+errF.Error(), http.StatusBadRequest, "DNS001")
+			return
+		}
+
+		entries := []DNSQueryLogEntry{}
+
+		if utils.GetMainConfig().ConstellationConfig.DNSQueryLog {
+			c, errCo := utils.GetCollection(utils.GetRootAppId(), "dnslogs")
+			if errCo != nil {
+				utils.Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+			}
+
+			opts := options.Find().SetLimit(int64(filter.limit)).SetSort(bson.D{{Key: "date", Value: -1}})
+
+			cursor, err := c.Find(nil, filter.bson(), opts)
+			if err != nil {
+				utils.Error("DNSLogs: Error while getting entries", err)
+				utils.HTTPError(w, "DNS Logs Get Error", http.StatusInternalServerError, "DNS002")
+				return
+			}
+			defer cursor.Close(nil)
+
+			if err = cursor.All(nil, &entries); err != nil {
+				utils.Error("DNSLogs: Error while decoding entries", err)
+				utils.HTTPError(w, "DNS Logs Get Error", http.StatusInternalServerError, "DNS002")
+				return
+			}
+		} else {
+			for _, entry := range recentDNSQueries() {
+				if filter.matches(entry) {
+					entries = append(entries, entry)
+					if len(entries) >= filter.limit {
+						break
+					}
+				}
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   entries,
+		})
+	} else {
+		utils.Error("DNSLogs: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// API_GetDNSStats returns the counters since the start of the server, per client and domain
+func API_GetDNSStats(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   getDNSStats(),
+		})
+	} else {
+		utils.Error("DNSStats: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+// API_DNSBlocklists lists the blocklists with their domain counts, POST downloads them again
+func API_DNSBlocklists(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" || req.Method == "POST" {
+		if req.Method == "POST" {
+			RefreshDNSBlocklists(true)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"domains": len(getDNSBlocklists()),
+				"lists":   getDNSBlocklistsStatus(),
+			},
+		})
+	} else {
+		utils.Error("DNSBlocklists: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+type DNSDevicePolicyRequestJSON struct {
+	// any name DeviceCreate accepted
+	DeviceName string `json:"deviceName" validate:"required"`
+	// empty to use the policy of the user
+	Policy string `json:"policy"`
+}
+
+// API_DNSDevicePolicy sets the DNS policy of a device
+func API_DNSDevicePolicy(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "POST" {
+		var request DNSDevicePolicyRequestJSON
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			utils.Error("DNSDevicePolicy: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request", http.StatusBadRequest, "DNS003")
+			return
+		}
+
+		if err := utils.Validate.Struct(request); err != nil {
+			utils.Error("DNSDevicePolicy: Invalid User Request", err)
+			utils.HTTPError(w, "Invalid request: "+err.Error(), http.StatusBadRequest, "DNS003")
+			return
+		}
+
+		if request.Policy != "" && !dnsPolicyExists(request.Policy) {
+			utils.Error("DNSDevicePolicy: Unknown policy "+request.Policy, nil)
+			utils.HTTPError(w, "Unknown DNS policy", http.StatusBadRequest, "DNS004")
+			return
+		}
+
+		deviceName := utils.Sanitize(request.DeviceName)
+
+		c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "devices")
+		defer closeDb()
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		result, err := c.UpdateOne(nil, map[string]interface{}{
+			"DeviceName": deviceName,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"DNSPolicy": request.Policy,
+			},
+		})
+
+		if err != nil {
+			utils.Error("DNSDevicePolicy: Error while updating device", err)
+			utils.HTTPError(w, "Device Update Error: "+err.Error(), http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		if result.MatchedCount == 0 {
+			utils.Error("DNSDevicePolicy: Device not found "+deviceName, nil)
+			utils.HTTPError(w, "Device not found", http.StatusNotFound, "DNS005")
+			return
+		}
+
+		invalidateDNSDevices()
+
+		utils.Log("DNSDevicePolicy: Device " + deviceName + " now uses the DNS policy " + request.Policy)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+		})
+	} else {
+		utils.Error("DNSDevicePolicy: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -2,13 +2,18 @@ package cron
 
 import (
 	"strconv"
+	"strings"
+	"bytes"
 	"time"
 	"context"
 	"errors"
 	"io"
 	"bufio"
+	"os"
 	"os/exec"
 	"fmt"
+	"math"
+	"sync"
 
 	"github.com/go-co-op/gocron/v2"
 
@@ -39,6 +44,22 @@ type ConfigJob struct {
 	Container string
 }
 
+// how long a command is waited for after its deadline, and its output after it exited
+const containerKillGrace = 5 * time.Second
+
+// killed at the deadline with timeout, or with a watchdog when the container has no timeout.
+// The watchdog only kills the command, not the processes it started in the background
+const containerDeadlineScript = `t=$1; shift
+if command -v timeout >/dev/null 2>&1; then exec timeout -s KILL "$t" "$@"; fi
+"$@" &
+pid=$!
+(trap 'kill $s 2>/dev/null; exit 0' TERM; sleep "$t" & s=$!; wait $s; kill -KILL $pid 2>/dev/null) &
+watchdog=$!
+wait $pid
+code=$?
+kill $watchdog 2>/dev/null
+exit $code`
+
 var jobsList = map[string]map[string]ConfigJob{}
 var wasInit = false
 
@@ -67,28 +88,66 @@ func streamLogs(r io.Reader, OnLog func(string)) {
 	}
 }
 
+// logWriter logs the output line by line
+type logWriter struct {
+	sync.Mutex
+	OnLog func(string)
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+		w.OnLog(strings.TrimSuffix(string(w.partial[:end]), "\r"))
+		w.partial = w.partial[end+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs the last line when it has no line break
+func (w *logWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.partial) > 0 {
+		w.OnLog(string(w.partial))
+		w.partial = nil
+	}
+}
+
 func getJobsList() map[string]map[string]ConfigJob {
 	return jobsList
 }
 
 func JobFromCommand(command string, args ...string) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+	return JobFromCommandWithEnv(nil, command, args...)
+}
+
+// env entries (KEY=value) are added on top of the Cosmos process environment
+func JobFromCommandWithEnv(env []string, command string, args ...string) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
 	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
 		// Create a command that respects the provided context
 		cmd := exec.CommandContext(ctx, command, args...)
 
-		// Getting the pipe for standard output
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-				OnFail(err)
-				return
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
 		}
 
-		// Getting the pipe for standard error
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-				OnFail(err)
-				return
-		}
+		// Wait returns once all the output is logged, or WaitDelay after the
+		// process exited when something it started keeps the output open
+		stdout := &logWriter{OnLog: OnLog}
+		stderr := &logWriter{OnLog: OnLog}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.WaitDelay = containerKillGrace
 
 		utils.Debug("Running command: " + cmd.String())
 		
@@ -98,12 +157,10 @@ func JobFromCommand(command string, args ...string) func(OnLog func(string), OnF
 				return
 		}
 
-		// Concurrently read from stdout and stderr
-		go streamLogs(stdout, OnLog)
-		go streamLogs(stderr, OnLog)
-
 		// Wait for the command to finish
-		err = cmd.Wait()
+		err := cmd.Wait()
+		stdout.Flush()
+		stderr.Flush()
 		if err != nil {
 				OnFail(err)
 				return
@@ -114,6 +171,25 @@ func JobFromCommand(command string, args ...string) func(OnLog func(string), OnF
 }
 
 func JobFromContainerCommand(containerID string, command string, args ...string) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+	return JobFromContainerCommandWithEnv(containerID, nil, command, args...)
+}
+
+// containerDeadlineCmd makes the command kill itself in the container at the deadline of ctx
+func containerDeadlineCmd(ctx context.Context, cmd []string) []string {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return cmd
+	}
+
+	seconds := int(math.Ceil(time.Until(deadline).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return append([]string{"sh", "-c", containerDeadlineScript, "sh", strconv.Itoa(seconds)}, cmd...)
+}
+
+func JobFromContainerCommandWithEnv(containerID string, env []string, command string, args ...string) func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
 	return func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
 			// Connect to Docker
 			err := docker.Connect()
@@ -136,7 +212,8 @@ func JobFromContainerCommand(containerID string, command string, args ...string)
 
 			// Create exec configuration
 			execConfig := types.ExecConfig{
-					Cmd:          append([]string{command}, args...),
+					Cmd:          containerDeadlineCmd(ctx, append([]string{command}, args...)),
+					Env:          env,
 					AttachStdout: true,
 					AttachStderr: true,
 			}
@@ -157,17 +234,36 @@ func JobFromContainerCommand(containerID string, command string, args ...string)
 			defer execAttach.Close()
 
 			// Stream logs from exec
-			go streamLogs(execAttach.Reader, OnLog)
+			logsDone := make(chan bool)
+			go (func() {
+					streamLogs(execAttach.Reader, OnLog)
+					close(logsDone)
+			})()
+
+			// the stream ends with the process, unless something it started keeps it open
+			waitLogs := func() {
+					select {
+					case <-logsDone:
+					case <-time.After(containerKillGrace):
+							execAttach.Close()
+							<-logsDone
+					}
+			}
 
 			// Inspect exec process to wait for completion
+			var deadlineAt time.Time
 			for {
-					execInspect, err := docker.DockerClient.ContainerExecInspect(ctx, execID.ID)
+					// not ctx, the process is still waited for a while after the deadline
+					execInspect, err := docker.DockerClient.ContainerExecInspect(context.Background(), execID.ID)
 					if err != nil {
+							execAttach.Close()
+							<-logsDone
 							OnFail(err)
 							return
 					}
 
 					if !execInspect.Running {
+							waitLogs()
 							if execInspect.ExitCode == 0 {
 									OnSuccess()
 							} else {
@@ -176,6 +272,17 @@ func JobFromContainerCommand(containerID string, command string, args ...string)
 							break
 					}
 
+					if ctx.Err() != nil {
+							if deadlineAt.IsZero() {
+									deadlineAt = time.Now()
+							} else if time.Since(deadlineAt) > containerKillGrace {
+									execAttach.Close()
+									<-logsDone
+									OnFail(ctx.Err())
+									return
+							}
+					}
+
 					// Don't spam the API
 					time.Sleep(500 * time.Millisecond)
 			}
@@ -34,7 +34,15 @@ func CheckPorts() error {
 		expectedPort = HTTPSPort
 	}
 
+	// TCP / UDP routes are listened on by Cosmos itself, on the same port
+	streamPorts := []string{}
+
 	for _, route := range routes {
+		if !route.Disabled && (route.Mode == "TCP" || route.Mode == "UDP") && route.ListenPort != "" {
+			streamPorts = append(streamPorts, route.ListenPort + ":" + route.ListenPort + "/" + strings.ToLower(string(route.Mode)))
+			continue
+		}
+
 		if route.UseHost && strings.Contains(route.Host, ":") {
 			hostname := route.Host
 			port := strings.Split(hostname, ":")[1]
@@ -98,6 +106,20 @@ func CheckPorts() error {
 		}
 	}
 
+	existingPorts := map[string]struct{}{}
+	for _, port := range finalPorts {
+		existingPorts[port] = struct{}{}
+	}
+
+	for _, port := range streamPorts {
+		if _, ok := existingPorts[port]; !ok {
+			utils.Debug("Stream port "+port+" is not mapped. Adding it.")
+			finalPorts = append(finalPorts, port)
+			existingPorts[port] = struct{}{}
+			hasChanged = true
+		}
+	}
+
 	if hasChanged {
 		utils.Log("Port mapping changed. Needs update.")
 		utils.Log("New ports: " + strings.Join(finalPorts, ", "))
@@ -22,6 +22,7 @@ import (
 		"github.com/go-chi/httprate"
 		"crypto/tls"
 		"github.com/foomo/tlsconfig"
+		"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 		"context"
     "net/http/pprof"
 )
@@ -48,10 +49,17 @@ func startHTTPServer(router *mux.Router) error {
 	} else {
 		proxy.InitInternalTCPProxy()
 	}
+
+	proxy.InitStreamProxies()
 	
 	utils.Log("Listening to HTTP on : 0.0.0.0:" + serverPortHTTP)
 
-	return HTTPServer.ListenAndServe()
+	listener, err := utils.ListenHTTP(HTTPServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	return HTTPServer.Serve(listener)
 }
 
 func startHTTPSServer(router *mux.Router) error {
@@ -65,8 +73,9 @@ func startHTTPSServer(router *mux.Router) error {
 
 		httpRouter.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// if AllowHTTPLocalIPAccess is on, allow local IP access via HTTP
-			utils.Debug("SERVING LOCAL IP ACCESS VIA HTTP?? " + r.RemoteAddr + " " + strconv.FormatBool(utils.GetMainConfig().HTTPConfig.AllowHTTPLocalIPAccess) + " " + strconv.FormatBool(utils.IsLocalIP(r.RemoteAddr)))
-			if utils.GetMainConfig().HTTPConfig.AllowHTTPLocalIPAccess && utils.IsLocalIP(r.RemoteAddr) {
+			clientIP := utils.GetClientIP(r)
+			utils.Debug("SERVING LOCAL IP ACCESS VIA HTTP?? " + clientIP + " " + strconv.FormatBool(utils.GetMainConfig().HTTPConfig.AllowHTTPLocalIPAccess) + " " + strconv.FormatBool(utils.IsLocalIP(clientIP)))
+			if utils.GetMainConfig().HTTPConfig.AllowHTTPLocalIPAccess && utils.IsLocalIP(clientIP) {
 				// use router 
 				router.ServeHTTP(w, r)
 			} else {
@@ -89,11 +98,14 @@ func startHTTPSServer(router *mux.Router) error {
 			ReadHeaderTimeout: 10 * time.Second,
 			WriteTimeout: 0,
 			IdleTimeout: 30 * time.Second,
-			Handler: httpRouter,
+			Handler: utils.ACMEChallengeMiddleware(httpRouter),
 			DisableGeneralOptionsHandler: true,
 		}
 
-		err := HTTPServer2.ListenAndServe()
+		listener, err := utils.ListenHTTP(HTTPServer2.Addr)
+		if err == nil {
+			err = HTTPServer2.Serve(listener)
+		}
 		
 		if err != nil && err != http.ErrServerClosed {
 			utils.Fatal("Listening to HTTP (Redirecting to HTTPS)", err)
@@ -118,7 +130,12 @@ func startHTTPSServer(router *mux.Router) error {
 		utils.Fatal("Getting Certificate pair", errCert)
 	}
 
+	// fallback for clients without SNI or hostnames without a certificate
 	tlsConf.Certificates = []tls.Certificate{cert}
+	tlsConf.GetCertificate = utils.CertStore.GetCertificate
+	tlsConf.GetConfigForClient = utils.ClientCertificateTLSConfig(tlsConf)
+	// for TLS-ALPN-01 challenges of certificates requested after startup
+	tlsConf.NextProtos = append(tlsConf.NextProtos, tlsalpn01.ACMETLS1Protocol)
 
 	HTTPServer = &http.Server{
 		TLSConfig: tlsConf,
@@ -138,9 +155,16 @@ func startHTTPSServer(router *mux.Router) error {
 		proxy.InitInternalTCPProxy()
 	}
 
+	proxy.InitStreamProxies()
+
 	utils.Log("Now listening to HTTPS on :" + serverPortHTTPS)
 
-	return HTTPServer.ListenAndServeTLS("", "")
+	listener, err := utils.ListenHTTP(HTTPServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	return HTTPServer.ServeTLS(listener, "", "")
 }
 
 func tokenMiddleware(next http.Handler) http.Handler {
@@ -149,6 +173,25 @@ func tokenMiddleware(next http.Handler) http.Handler {
 		r.Header.Del("x-cosmos-user")
 		r.Header.Del("x-cosmos-role")
 		r.Header.Del("x-cosmos-mfa")
+		r.Header.Del("x-cosmos-token")
+		r.Header.Del("x-cosmos-token-scopes")
+
+		if user.HasAPIToken(r) {
+			token, u, err := user.RefreshAPIToken(w, r)
+
+			if err != nil {
+				return
+			}
+
+			r.Header.Set("x-cosmos-user", u.Nickname)
+			r.Header.Set("x-cosmos-role", strconv.Itoa((int)(u.Role)))
+			r.Header.Set("x-cosmos-mfa", "0")
+			r.Header.Set("x-cosmos-token", token.Name)
+			r.Header.Set("x-cosmos-token-scopes", strings.Join(token.Scopes, ","))
+
+			next.ServeHTTP(w, r)
+			return
+		}
 
 		u, err := user.RefreshUserToken(w, r)
 
@@ -186,7 +229,7 @@ func SecureAPI(userRouter *mux.Router, public bool, publicCors bool) {
 
 	userRouter.Use(utils.MiddlewareTimeout(45 * time.Second))
 	userRouter.Use(httprate.Limit(180, 1*time.Minute, 
-		httprate.WithKeyFuncs(httprate.KeyByIP),
+		httprate.WithKeyFuncs(utils.ClientIPRateLimitKey),
     httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
 			utils.Error("Too many requests. Throttling", nil)
 			utils.HTTPError(w, "Too many requests", 
@@ -238,7 +281,7 @@ func InitServer() *mux.Router {
 	oldDomains := baseMainConfig.HTTPConfig.TLSKeyHostsCached
 	falledBack := false
 
-	NeedsRefresh := baseMainConfig.HTTPConfig.ForceHTTPSCertificateRenewal || (tlsCert == "" || tlsKey == "") || utils.HasAnyNewItem(domains, oldDomains) || !CertificateIsExpiredSoon(baseMainConfig.HTTPConfig.TLSValidUntil)
+	NeedsRefresh := baseMainConfig.HTTPConfig.ForceHTTPSCertificateRenewal || (tlsCert == "" || tlsKey == "") || len(oldDomains) == 0 || !utils.StringArrayContains(oldDomains, domains[0]) || !CertificateIsExpiredSoon(baseMainConfig.HTTPConfig.TLSValidUntil)
 	
 	// If we have a certificate, we can fallback to it if necessary
 	CanFallback := tlsCert != "" && tlsKey != "" && 
@@ -331,6 +374,14 @@ func InitServer() *mux.Router {
 		tlsKey = priv
 	}
 
+	// new hostnames get their own certificate instead of renewing the main one
+	utils.ReloadCertificateStore(tlsCert, tlsKey)
+
+	if missing := utils.MissingCertificateDomains(domains); len(missing) > 0 {
+		utils.Log("Requesting certificates for new domains: " + strings.Join(missing, ", "))
+		go utils.IssueDomainCertificates(missing, HTTPConfig.HTTPSCertificateMode)
+	}
+
 	if ((HTTPConfig.AuthPublicKey == "" || HTTPConfig.AuthPrivateKey == "") && HTTPConfig.GenerateMissingAuthCert) {
 		utils.Log("Generating new Auth ED25519 certificate")
 		pub, priv := utils.GenerateEd25519Certificates()
@@ -345,6 +396,12 @@ func InitServer() *mux.Router {
 	utils.Log("Initialising HTTP(S) Router and all routes")
 
 	router := mux.NewRouter().StrictSlash(true)
+
+	utils.InitTrustedProxies()
+	router.Use(utils.ClientIPMiddleware)
+
+	utils.InitAccessLog()
+	router.Use(utils.AccessLogMiddleware)
 	
 	router.Use(utils.BlockBannedIPs)
 
@@ -395,6 +452,11 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/users/{nickname}", user.UsersIdRoute)
 	srapiAdmin.HandleFunc("/api/users", user.UsersRoute)
 
+	srapiAdmin.HandleFunc("/api/api-tokens/{id}", user.APITokenIdRoute)
+	srapiAdmin.HandleFunc("/api/api-tokens", user.APITokensRoute)
+	srapiAdmin.HandleFunc("/api/client-certificates/{id}", user.ClientCertificateIdRoute)
+	srapiAdmin.HandleFunc("/api/client-certificates", user.ClientCertificatesRoute)
+
 	srapiAdmin.HandleFunc("/api/images/pull-if-missing", docker.PullImageIfMissing)
 	srapiAdmin.HandleFunc("/api/images/pull", docker.PullImage)
 	srapiAdmin.HandleFunc("/api/images", docker.InspectImageRoute)
@@ -435,12 +497,23 @@ func InitServer() *mux.Router {
 	srapiAdmin.HandleFunc("/api/constellation/config", constellation.API_GetConfig)
 	srapiAdmin.HandleFunc("/api/constellation/logs", constellation.API_GetLogs)
 	srapiAdmin.HandleFunc("/api/constellation/block", constellation.DeviceBlock)
+	srapiAdmin.HandleFunc("/api/constellation/dns/logs", constellation.API_GetDNSLogs)
+	srapiAdmin.HandleFunc("/api/constellation/dns/stats", constellation.API_GetDNSStats)
+	srapiAdmin.HandleFunc("/api/constellation/dns/blocklists", constellation.API_DNSBlocklists)
+	srapiAdmin.HandleFunc("/api/constellation/dns/policy", constellation.API_DNSDevicePolicy)
 
 	srapiAdmin.HandleFunc("/api/events", metrics.API_ListEvents)
+	srapiAdmin.HandleFunc("/api/access-logs", metrics.API_ListAccessLogs)
 
 	srapiAdmin.HandleFunc("/api/metrics", metrics.API_GetMetrics)
 	srapiAdmin.HandleFunc("/api/reset-metrics", metrics.API_ResetMetrics)
 	srapiAdmin.HandleFunc("/api/list-metrics", metrics.ListMetrics)
+	srapiAdmin.HandleFunc("/api/alerts/states", metrics.API_GetAlertStates)
+	srapiAdmin.HandleFunc("/api/alerts/history", metrics.API_ListAlertHistory)
+
+	srapiAdmin.HandleFunc("/api/smart-shield/bans", proxy.BansRoute)
+	srapiAdmin.HandleFunc("/api/cache", proxy.CacheRoute)
+	srapiAdmin.HandleFunc("/api/certificates", utils.CertificatesRoute)
 
 	srapiAdmin.HandleFunc("/api/notifications/read", utils.MarkAsRead)
 	srapiAdmin.HandleFunc("/api/notifications", utils.NotifGet)
@@ -511,6 +584,15 @@ func InitServer() *mux.Router {
 	}
 
 	router = proxy.BuildFromConfig(router, HTTPConfig.ProxyConfig)
+
+	// registered after the routes so apps exposing their own /metrics keep working
+	if config.Prometheus.Enabled {
+		var prometheusHandler http.Handler = http.HandlerFunc(metrics.API_PrometheusMetrics)
+		if(!config.HTTPConfig.AcceptAllInsecureHostname) {
+			prometheusHandler = utils.EnsureHostname(prometheusHandler)
+		}
+		router.Handle("/metrics", prometheusHandler)
+	}
 	
 	router.HandleFunc("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
     http.Redirect(w, r, "/cosmos-ui/", http.StatusTemporaryRedirect)
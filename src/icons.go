@@ -97,19 +97,12 @@ func GetFavicon(w http.ResponseWriter, req *http.Request) {
 	}
 	
 	if os.Getenv("HOSTNAME") == "" || utils.IsHostNetwork && isServappMode != "" {
-		parsedURL, err := url.Parse(siteurl)
+		siteurl, err = utils.ResolveContainerURL(siteurl)
 		if err != nil {
 			utils.Error("Favicon: URL parse", err)
 			utils.HTTPError(w, "URL parse", http.StatusInternalServerError, "FA001")
 			return
 		}
-
-		hostname := parsedURL.Hostname()
-
-		ip, _ := utils.GetContainerIPByName(hostname)
-		if ip != "" {
-			siteurl = strings.Replace(siteurl, hostname, ip, 1)
-		}
 	}
 
 
@@ -286,19 +279,12 @@ func PingURL(w http.ResponseWriter, req *http.Request) {
 	}
 	
 	if os.Getenv("HOSTNAME") == "" || utils.IsHostNetwork && isServappMode != "" {
-		parsedURL, err := url.Parse(siteurl)
+		siteurl, err = utils.ResolveContainerURL(siteurl)
 		if err != nil {
 			utils.Error("Favicon: URL parse", err)
 			utils.HTTPError(w, "URL parse", http.StatusInternalServerError, "FA001")
 			return
 		}
-
-		hostname := parsedURL.Hostname()
-
-		ip, _ := utils.GetContainerIPByName(hostname)
-		if ip != "" {
-			siteurl = strings.Replace(siteurl, hostname, ip, 1)
-		}
 	}
 
 	if(req.Method == "GET") { 
@@ -13,6 +13,7 @@ import (
 	"github.com/madejackson/cosmos-server/src/metrics"
 	"github.com/madejackson/cosmos-server/src/storage"
 	"github.com/madejackson/cosmos-server/src/cron"
+	"github.com/madejackson/cosmos-server/src/proxy"
 )
 
 func main() {
@@ -65,6 +66,8 @@ func main() {
 
 		metrics.Init()
 
+		proxy.LoadBans()
+
 		utils.Log("Starting market services...")
 
 		market.Init()
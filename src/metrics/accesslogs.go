@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type accessLogFilter struct {
+	route      string
+	ip         string
+	user       string
+	shield     string
+	status     int
+	statusFrom int
+	statusTo   int
+	from       time.Time
+	to         time.Time
+	limit      int
+}
+
+func parseAccessLogFilter(query map[string][]string) (accessLogFilter, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	filter := accessLogFilter{
+		route:  get("route"),
+		ip:     get("ip"),
+		user:   get("user"),
+		shield: get("shield"),
+		limit:  100,
+	}
+
+	// exact status, or a class such as 4xx
+	if status := strings.ToLower(get("status")); status != "" {
+		if len(status) == 3 && strings.HasSuffix(status, "xx") {
+			class, err := strconv.Atoi(status[:1])
+			if err != nil {
+				return filter, err
+			}
+			filter.statusFrom = class * 100
+			filter.statusTo = class*100 + 99
+		} else {
+			code, err := strconv.Atoi(status)
+			if err != nil {
+				return filter, err
+			}
+			filter.status = code
+		}
+	}
+
+	if from := get("from"); from != "" {
+		date, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, err
+		}
+		filter.from = date
+	}
+
+	if to := get("to"); to != "" {
+		date, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, err
+		}
+		filter.to = date
+	}
+
+	if limit := get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil {
+			return filter, err
+		}
+		if value > 0 && value <= 1000 {
+			filter.limit = value
+		}
+	}
+
+	return filter, nil
+}
+
+func (filter accessLogFilter) bson() bson.M {
+	query := bson.M{}
+
+	if filter.route != "" {
+		query["route"] = filter.route
+	}
+	if filter.ip != "" {
+		query["clientIP"] = filter.ip
+	}
+	if filter.user != "" {
+		query["user"] = filter.user
+	}
+	if filter.shield != "" {
+		query["shield"] = filter.shield
+	}
+
+	if filter.status != 0 {
+		query["status"] = filter.status
+	} else if filter.statusTo != 0 {
+		query["status"] = bson.M{"$gte": filter.statusFrom, "$lte": filter.statusTo}
+	}
+
+	if !filter.from.IsZero() || !filter.to.IsZero() {
+		date := bson.M{}
+		if !filter.from.IsZero() {
+			date["$gte"] = filter.from
+		}
+		if !filter.to.IsZero() {
+			date["$lte"] = filter.to
+		}
+		query["date"] = date
+	}
+
+	return query
+}
+
+func (filter accessLogFilter) matches(entry utils.AccessLogEntry) bool {
+	if filter.route != "" && entry.Route != filter.route {
+		return false
+	}
+	if filter.ip != "" && entry.ClientIP != filter.ip {
+		return false
+	}
+	if filter.user != "" && entry.User != filter.user {
+		return false
+	}
+	if filter.shield != "" && entry.Shield != filter.shield {
+		return false
+	}
+	if filter.status != 0 && entry.Status != filter.status {
+		return false
+	}
+	if filter.statusTo != 0 && (entry.Status < filter.statusFrom || entry.Status > filter.statusTo) {
+		return false
+	}
+	if !filter.from.IsZero() && entry.Date.Before(filter.from) {
+		return false
+	}
+	if !filter.to.IsZero() && entry.Date.After(filter.to) {
+		return false
+	}
+	return true
+}
+
+// readAccessLogFile is used when the database is disabled, it only reads the current JSON file
+// and keeps the last limit matching entries in a ring
+func readAccessLogFile(filter accessLogFilter) ([]utils.AccessLogEntry, error) {
+	file, err := os.Open(utils.AccessLogFile())
+	if os.IsNotExist(err) {
+		return []utils.AccessLogEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ring := make([]utils.AccessLogEntry, 0, filter.limit)
+	next := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		entry := utils.AccessLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+
+		if len(ring) < filter.limit {
+			ring = append(ring, entry)
+		} else {
+			ring[next] = entry
+		}
+		next = (next + 1) % filter.limit
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest first
+	size := len(ring)
+	entries := make([]utils.AccessLogEntry, 0, size)
+	for i := 1; i <= size; i++ {
+		entries = append(entries, ring[(next-i+size)%size])
+	}
+
+	return entries, nil
+}
+
+func API_ListAccessLogs(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		config := utils.GetMainConfig().AccessLog
+
+		filter, errF := parseAccessLogFilter(req.URL.Query())
+		if errF != nil {
+			utils.Error("AccessLogs: Invalid filter", errF)
+			utils.HTTPError(w, "Invalid filter: "+errF.Error(), http.StatusBadRequest, "AL001")
+			return
+		}
+
+		entries := []utils.AccessLogEntry{}
+
+		if config.Database {
+			c, errCo := utils.GetCollection(utils.GetRootAppId(), "accesslogs")
+			if errCo != nil {
+				utils.Error("Database Connect", errCo)
+				utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+				return
+			}
+
+			opts := options.Find().SetLimit(int64(filter.limit)).SetSort(bson.D{{Key: "date", Value: -1}})
+
+			cursor, err := c.Find(nil, filter.bson(), opts)
+			if err != nil {
+				utils.Error("AccessLogs: Error while getting entries", err)
+				utils.HTTPError(w, "Access Logs Get Error", http.StatusInternalServerError, "AL002")
+				return
+			}
+			defer cursor.Close(nil)
+
+			if err = cursor.All(nil, &entries); err != nil {
+				utils.Error("AccessLogs: Error while decoding entries", err)
+				utils.HTTPError(w, "Access Logs Get Error", http.StatusInternalServerError, "AL002")
+				return
+			}
+		} else if config.Format == utils.ACCESS_LOG_JSON {
+			var err error
+			entries, err = readAccessLogFile(filter)
+			if err != nil {
+				utils.Error("AccessLogs: Error while reading "+utils.AccessLogFile(), err)
+				utils.HTTPError(w, "Access Logs Get Error", http.StatusInternalServerError, "AL002")
+				return
+			}
+		} else {
+			utils.HTTPError(w, "Filtering the access log needs the database or the JSON format", http.StatusBadRequest, "AL003")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   entries,
+		})
+	} else {
+		utils.Error("AccessLogs: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
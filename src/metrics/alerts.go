@@ -13,6 +13,8 @@ import (
 func CheckAlerts(TrackingMetric string, Period string, metric utils.AlertMetricTrack, Value int) {
 	config := utils.GetMainConfig()
 	ActiveAlerts := config.MonitoringAlerts
+
+	metric.Value = Value
 	
 	alerts := []utils.Alert{}
 	ok := false
@@ -48,10 +50,6 @@ func CheckAlerts(TrackingMetric string, Period string, metric utils.AlertMetricT
 			continue
 		}
 
-		if alert.Throttled && alert.LastTriggered.Add(time.Hour * 24).After(time.Now()) {
-			continue
-		}
-		
 		ValueToTest := Value 
 
 		if alert.Condition.Percent {
@@ -61,19 +59,16 @@ func CheckAlerts(TrackingMetric string, Period string, metric utils.AlertMetricT
 		}
 
 		// Check if the condition is met
+		conditionMet := false
 		if alert.Condition.Operator == "gt" {
-			if ValueToTest > alert.Condition.Value {
-				ExecuteAllActions(alert, alert.Actions, metric)
-			}
+			conditionMet = ValueToTest > alert.Condition.Value
 		} else if alert.Condition.Operator == "lt" {
-			if ValueToTest < alert.Condition.Value {
-				ExecuteAllActions(alert, alert.Actions, metric)
-			}
+			conditionMet = ValueToTest < alert.Condition.Value
 		} else if alert.Condition.Operator == "eq" {
-			if ValueToTest == alert.Condition.Value {
-				ExecuteAllActions(alert, alert.Actions, metric)
-			}
+			conditionMet = ValueToTest == alert.Condition.Value
 		}
+
+		UpdateAlertState(alert, metric, conditionMet)
 	}
 }
 
@@ -139,6 +134,12 @@ more information.<br />`, alert.Severity, metric.Key))
 	} else if action.Type == "webhook" {
 		utils.Debug("Calling webhook " + action.Target)
 
+		if action.Target == "" {
+			utils.Warn("Alert triggered but webhook has no target URL")
+		} else {
+			go SendWebhook(alert, action, metric, ALERT_STATE_FIRING)
+		}
+
 	} else if action.Type == "stop" || action.Type == "restart" {
 		utils.Debug("Stopping/reestarting application")
 
@@ -190,5 +191,60 @@ more information.<br />`, alert.Severity, metric.Key))
 
 	} else if action.Type == "script" {
 		utils.Debug("Executing script")
+
+		if action.Target == "" {
+			utils.Warn("Alert triggered but script has no command")
+		} else {
+			go RunAlertScript(alert, action, metric)
+		}
+	}
+}
+
+func ExecuteResolvedActions(alert utils.Alert, metric utils.AlertMetricTrack) {
+	utils.Debug("Alert resolved: " + alert.Name)
+
+	utils.TriggerEvent(
+		"cosmos.metrics.alert.resolved",
+		"Alert resolved",
+		"success",
+		"",
+		map[string]interface{}{
+			"alert": alert.Name,
+			"metric": metric.Key,
+			"object": metric.Object,
+			"value": metric.Value,
+			"severity": alert.Severity,
+	})
+
+	// only actions that tell someone about the alert make sense on recovery
+	for _, action := range alert.Actions {
+		if action.Type == "email" {
+			if utils.GetMainConfig().EmailConfig.Enabled {
+				users := utils.ListAllUsers("admin")
+				for _, user := range users {
+					if user.Email != "" {
+						utils.SendEmail([]string{user.Email}, "Alert Resolved: " + alert.Name,
+						fmt.Sprintf(`<h1>Alert Resolved [%s]</h1>
+You are recevining this email because you are admin on a Cosmos
+server where an Alert has been subscribed to.<br />
+You can manage your subscriptions in the Monitoring tab.<br />
+The alert on %s is no longer triggered. Please refer to the Monitoring tab for
+more information.<br />`, alert.Severity, metric.Key))
+					}
+				}
+			}
+		} else if action.Type == "webhook" {
+			if action.Target != "" {
+				go SendWebhook(alert, action, metric, ALERT_STATE_RESOLVED)
+			}
+		} else if action.Type == "notification" {
+			utils.WriteNotification(utils.Notification{
+				Recipient: "admin",
+				Title: "Alert resolved",
+				Message: "The alert \"" + alert.Name + "\" is resolved.",
+				Level: "info",
+				Link: "/cosmos-ui/monitoring",
+			})
+		}
 	}
-}
\ No newline at end of file
+}
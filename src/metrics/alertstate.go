@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	ALERT_STATE_INACTIVE = "inactive"
+	ALERT_STATE_PENDING  = "pending"
+	ALERT_STATE_FIRING   = "firing"
+	ALERT_STATE_RESOLVED = "resolved"
+)
+
+// cooldown used by alerts created before Cooldown existed
+const legacyThrottleCooldown = time.Hour * 24
+
+type AlertState struct {
+	Alert        string    `json:"alert"`
+	Key          string    `json:"key"`
+	Object       string    `json:"object"`
+	State        string    `json:"state"`
+	PendingCount int       `json:"pendingCount"`
+	Since        time.Time `json:"since"`
+	LastNotified time.Time `json:"lastNotified"`
+	LastValue    int       `json:"lastValue"`
+}
+
+type AlertHistoryEntry struct {
+	Id       primitive.ObjectID `json:"id" bson:"_id"`
+	Alert    string             `json:"alert" bson:"Alert"`
+	Key      string             `json:"key" bson:"Key"`
+	Object   string             `json:"object" bson:"Object"`
+	State    string             `json:"state" bson:"State"`
+	Value    int                `json:"value" bson:"Value"`
+	Notified bool               `json:"notified" bson:"Notified"`
+	Date     time.Time          `json:"date" bson:"Date"`
+}
+
+var alertStates = map[string]AlertState{}
+var alertStatesLock sync.Mutex
+
+func GetAlertCooldown(alert utils.Alert) time.Duration {
+	if alert.Cooldown > 0 {
+		return alert.Cooldown
+	}
+
+	if alert.Throttled {
+		return legacyThrottleCooldown
+	}
+
+	return 0
+}
+
+// UpdateAlertState moves the alert for this metric through
+// inactive -> pending -> firing -> resolved and runs the actions on transitions
+func UpdateAlertState(alert utils.Alert, metric utils.AlertMetricTrack, conditionMet bool) {
+	now := time.Now()
+	stateKey := alert.Name + "@" + metric.Key
+
+	alertStatesLock.Lock()
+
+	state, ok := alertStates[stateKey]
+	if !ok {
+		state = AlertState{
+			Alert:  alert.Name,
+			Key:    metric.Key,
+			Object: metric.Object,
+			State:  ALERT_STATE_INACTIVE,
+			Since:  now,
+		}
+	}
+
+	previous := state.State
+	state.LastValue = metric.Value
+	fired := false
+	resolved := false
+	notify := false
+
+	if conditionMet {
+		if state.State != ALERT_STATE_FIRING {
+			state.PendingCount++
+
+			required := alert.PendingPeriods
+			if required < 1 {
+				required = 1
+			}
+
+			if state.PendingCount >= required {
+				state.State = ALERT_STATE_FIRING
+				state.PendingCount = 0
+				fired = true
+			} else {
+				state.State = ALERT_STATE_PENDING
+			}
+		}
+	} else {
+		state.PendingCount = 0
+
+		if state.State == ALERT_STATE_FIRING {
+			state.State = ALERT_STATE_RESOLVED
+			resolved = true
+		} else if state.State == ALERT_STATE_PENDING {
+			state.State = ALERT_STATE_INACTIVE
+		}
+	}
+
+	if fired {
+		cooldown := GetAlertCooldown(alert)
+		notify = cooldown == 0 || state.LastNotified.Add(cooldown).Before(now)
+		if notify {
+			state.LastNotified = now
+		}
+	}
+
+	if state.State != previous {
+		state.Since = now
+	}
+
+	alertStates[stateKey] = state
+
+	alertStatesLock.Unlock()
+
+	if state.State != previous && state.State != ALERT_STATE_INACTIVE {
+		utils.BufferedDBWrite("alerts", map[string]interface{}{
+			"Alert":    alert.Name,
+			"Key":      metric.Key,
+			"Object":   metric.Object,
+			"State":    state.State,
+			"Value":    metric.Value,
+			"Notified": notify || (resolved && alert.NotifyResolved),
+			"Date":     now,
+		})
+	}
+
+	if fired {
+		if notify {
+			ExecuteAllActions(alert, alert.Actions, metric)
+		} else {
+			utils.Debug("Alert " + alert.Name + " is firing again but still in cooldown")
+		}
+	}
+
+	if resolved && alert.NotifyResolved {
+		ExecuteResolvedActions(alert, metric)
+	}
+}
+
+func GetAlertStates() []AlertState {
+	alertStatesLock.Lock()
+	defer alertStatesLock.Unlock()
+
+	return utils.Values(alertStates)
+}
+
+// LoadAlertStates restores the last known state of every alert, so an alert
+// that was firing before a restart does not fire again
+func LoadAlertStates() {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "alerts")
+	if errCo != nil {
+		utils.Error("Alerts - Database Connect", errCo)
+		return
+	}
+
+	history := []AlertHistoryEntry{}
+
+	opts := options.Find().SetLimit(1000).SetSort(bson.D{{Key: "Date", Value: -1}})
+
+	cursor, err := c.Find(nil, bson.M{}, opts)
+	if err != nil {
+		utils.Error("Alerts - Error while loading alert states", err)
+		return
+	}
+	defer cursor.Close(nil)
+
+	if err = cursor.All(nil, &history); err != nil {
+		utils.Error("Alerts - Error while decoding alert states", err)
+		return
+	}
+
+	alertStatesLock.Lock()
+	defer alertStatesLock.Unlock()
+
+	for _, entry := range history {
+		stateKey := entry.Alert + "@" + entry.Key
+
+		if _, ok := alertStates[stateKey]; ok {
+			continue
+		}
+
+		state := AlertState{
+			Alert:     entry.Alert,
+			Key:       entry.Key,
+			Object:    entry.Object,
+			State:     entry.State,
+			Since:     entry.Date,
+			LastValue: entry.Value,
+		}
+
+		// pending count is not persisted, start over
+		if state.State == ALERT_STATE_PENDING {
+			state.State = ALERT_STATE_INACTIVE
+		}
+
+		if entry.State == ALERT_STATE_FIRING && entry.Notified {
+			state.LastNotified = entry.Date
+		}
+
+		alertStates[stateKey] = state
+	}
+}
+
+func API_GetAlertStates(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   GetAlertStates(),
+		})
+	} else {
+		utils.Error("AlertStates: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func API_ListAlertHistory(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		query := req.URL.Query()
+
+		dbQuery := bson.M{}
+
+		if alert := query.Get("alert"); alert != "" {
+			dbQuery["Alert"] = alert
+		}
+
+		if key := query.Get("key"); key != "" {
+			dbQuery["Key"] = key
+		}
+
+		dateQuery := bson.M{}
+		if from, err := time.Parse("2006-01-02T15:04:05Z", query.Get("from")); err == nil {
+			dateQuery["$gte"] = from
+		}
+		if to, err := time.Parse("2006-01-02T15:04:05Z", query.Get("to")); err == nil {
+			dateQuery["$lte"] = to
+		}
+		if len(dateQuery) > 0 {
+			dbQuery["Date"] = dateQuery
+		}
+
+		if page := query.Get("page"); page != "" {
+			if pageId, err := primitive.ObjectIDFromHex(page); err == nil {
+				dbQuery["_id"] = bson.M{
+					"$lt": pageId,
+				}
+			}
+		}
+
+		c, errCo := utils.GetCollection(utils.GetRootAppId(), "alerts")
+		if errCo != nil {
+			utils.Error("Database Connect", errCo)
+			utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+			return
+		}
+
+		history := []AlertHistoryEntry{}
+
+		opts := options.Find().SetLimit(100).SetSort(bson.D{{Key: "Date", Value: -1}})
+
+		cursor, err := c.Find(nil, dbQuery, opts)
+		if err != nil {
+			utils.Error("alerts: Error while getting alert history", err)
+			utils.HTTPError(w, "alerts Get Error", http.StatusInternalServerError, "UD001")
+			return
+		}
+		defer cursor.Close(nil)
+
+		if err = cursor.All(nil, &history); err != nil {
+			utils.Error("alerts: Error while decoding alert history", err)
+			utils.HTTPError(w, "alerts decode Error", http.StatusInternalServerError, "UD002")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   history,
+		})
+	} else {
+		utils.Error("alerts: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
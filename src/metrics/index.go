@@ -43,6 +43,9 @@ type DataPush struct {
 
 var dataBuffer = map[string]DataPush{}
 
+// last complete period of every metric, used by the Prometheus exporter
+var latestMetrics = map[string]DataPush{}
+
 var lock = make(chan bool, 1)
 
 func GetDataBuffer() map[string]DataPush {
@@ -96,6 +99,7 @@ func SaveMetrics() {
 	for dpkey, dp := range dataBuffer {
 		if dp.Expire.Before(time.Now()) {
 			delete(dataBuffer, dpkey)
+			latestMetrics[dp.Key] = dp
 
 			scale := 1
 			if dp.Scale != 0 {
@@ -139,6 +143,9 @@ func SaveMetrics() {
 		}
 	}
 
+	// also when Prometheus does not scrape
+	evictStaleMetrics()
+
 	if len(operations) > 0 {
 		_, err := c.BulkWrite(nil, operations)
 		if err != nil {
@@ -246,6 +253,7 @@ func Run() {
 func Init() {
 	lastInserted = map[string]int{}
 
+	LoadAlertStates()
 	InitAggl()
 	Run()
 
@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/user"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+// metrics without an Object that still have a natural label dimension
+var prometheusLabelPrefixes = map[string]string{
+	"cosmos.system.cpu.":    "cpu",
+	"cosmos.system.temp.":   "sensor",
+	"cosmos.proxy.blocked.": "reason",
+}
+
+var prometheusUnits = map[string]string{
+	"B":  "bytes",
+	"%":  "percent",
+	"ms": "milliseconds",
+	"°C": "celsius",
+}
+
+// periods without a new value before a metric is no longer exported
+const prometheusStalePeriods = 5
+
+var prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type prometheusSample struct {
+	Labels map[string]string
+	Value  float64
+	Max    uint64
+}
+
+type prometheusFamily struct {
+	Name    string
+	Help    string
+	Samples []prometheusSample
+}
+
+func prometheusName(family string, unit string) string {
+	name := prometheusInvalidChars.ReplaceAllString(strings.ReplaceAll(family, ".", "_"), "_")
+
+	if suffix, ok := prometheusUnits[unit]; ok && !strings.HasSuffix(name, "_"+suffix) {
+		name += "_" + suffix
+	}
+
+	return name
+}
+
+func prometheusEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+// splitPrometheusKey turns a Cosmos metric key into a family name and its labels,
+// ex. cosmos.proxy.route.bytes.myapp -> cosmos.proxy.route.bytes{route="myapp"}
+func splitPrometheusKey(dp DataPush) (string, map[string]string) {
+	labels := map[string]string{}
+
+	if objectParts := strings.SplitN(dp.Object, "@", 2); len(objectParts) == 2 {
+		objectType, objectName := objectParts[0], objectParts[1]
+		labels[objectType] = objectName
+
+		// disk keys replace dots in the mount point
+		for _, suffix := range []string{objectName, strings.Replace(objectName, ".", "_", -1)} {
+			if strings.HasSuffix(dp.Key, "."+suffix) {
+				return strings.TrimSuffix(dp.Key, "."+suffix), labels
+			}
+		}
+
+		if lastDot := strings.LastIndex(dp.Key, "."); lastDot > 0 {
+			return dp.Key[:lastDot], labels
+		}
+
+		return dp.Key, labels
+	}
+
+	for prefix, label := range prometheusLabelPrefixes {
+		if strings.HasPrefix(dp.Key, prefix) && dp.Key != prefix+"all" {
+			labels[label] = strings.TrimPrefix(dp.Key, prefix)
+			return strings.TrimSuffix(prefix, "."), labels
+		}
+	}
+
+	return dp.Key, labels
+}
+
+// evictStaleMetrics forgets the metrics not pushed for prometheusStalePeriods, such as the
+// ones of deleted routes or containers. lock must be held
+func evictStaleMetrics() {
+	for key, dp := range latestMetrics {
+		period := dp.Period
+		if period <= 0 {
+			period = time.Minute
+		}
+
+		if time.Since(dp.Date) > prometheusStalePeriods*period {
+			delete(latestMetrics, key)
+		}
+	}
+}
+
+func GetPrometheusFamilies() []prometheusFamily {
+	lock <- true
+	evictStaleMetrics()
+	latest := make([]DataPush, 0, len(latestMetrics))
+	for _, dp := range latestMetrics {
+		latest = append(latest, dp)
+	}
+	<-lock
+
+	families := map[string]*prometheusFamily{}
+
+	for _, dp := range latest {
+		familyKey, labels := splitPrometheusKey(dp)
+		name := prometheusName(familyKey, dp.Unit)
+
+		family, ok := families[name]
+		if !ok {
+			help := dp.Label
+			for _, labelValue := range labels {
+				help = strings.TrimSpace(strings.TrimSuffix(help, labelValue))
+			}
+
+			family = &prometheusFamily{
+				Name: name,
+				Help: help,
+			}
+			families[name] = family
+		}
+
+		value := float64(dp.Value)
+		if dp.Scale > 1 {
+			value = value / float64(dp.Scale)
+		}
+
+		family.Samples = append(family.Samples, prometheusSample{
+			Labels: labels,
+			Value:  value,
+			Max:    dp.Max,
+		})
+	}
+
+	result := make([]prometheusFamily, 0, len(families))
+	for _, family := range families {
+		result = append(result, *family)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+func formatPrometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, prometheusInvalidChars.ReplaceAllString(key, "_")+`="`+prometheusEscape(labels[key])+`"`)
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func WritePrometheusMetrics(w http.ResponseWriter) {
+	var sb strings.Builder
+
+	for _, family := range GetPrometheusFamilies() {
+		sb.WriteString("# HELP " + family.Name + " " + prometheusEscape(family.Help) + "\n")
+		sb.WriteString("# TYPE " + family.Name + " gauge\n")
+
+		hasMax := false
+		for _, sample := range family.Samples {
+			sb.WriteString(family.Name + formatPrometheusLabels(sample.Labels) + " " + strconv.FormatFloat(sample.Value, 'f', -1, 64) + "\n")
+			if sample.Max > 0 {
+				hasMax = true
+			}
+		}
+
+		if hasMax {
+			sb.WriteString("# HELP " + family.Name + "_max Maximum value of " + family.Name + "\n")
+			sb.WriteString("# TYPE " + family.Name + "_max gauge\n")
+
+			for _, sample := range family.Samples {
+				if sample.Max > 0 {
+					sb.WriteString(family.Name + "_max" + formatPrometheusLabels(sample.Labels) + " " + strconv.FormatUint(sample.Max, 10) + "\n")
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+func hasPrometheusToken(req *http.Request, token string) bool {
+	if user.HasAPIToken(req) {
+		apiToken, _, err := user.CheckAPIToken(req)
+		if err != nil {
+			utils.Error("Prometheus: invalid API token", err)
+			return false
+		}
+
+		return utils.HasAPITokenScope(apiToken.Scopes, "metrics:read")
+	}
+
+	if token == "" {
+		return false
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// API_PrometheusMetrics serves the latest value of every metric in the Prometheus
+// text format. Access is granted with the configured bearer token, an API token
+// with the metrics:read scope, or to clients allowed by the IP whitelist /
+// Constellation restriction
+func API_PrometheusMetrics(w http.ResponseWriter, req *http.Request) {
+	config := utils.GetMainConfig().Prometheus
+
+	if !config.Enabled {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != "GET" {
+		utils.Error("Prometheus: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+
+	if hasPrometheusToken(req, config.Token) {
+		WritePrometheusMetrics(w)
+		return
+	}
+
+	if len(config.WhitelistInboundIPs) == 0 && !config.RestrictToConstellation {
+		utils.Error("Prometheus: request without a valid token", nil)
+		utils.HTTPError(w, "Unauthorized", http.StatusUnauthorized, "HTTP004")
+		return
+	}
+
+	utils.Restrictions(config.RestrictToConstellation, config.WhitelistInboundIPs)(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			WritePrometheusMetrics(w)
+		}),
+	).ServeHTTP(w, req)
+}
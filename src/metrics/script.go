@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/cron"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const scriptDefaultTimeout = 60 * time.Second
+const scriptMaxOutputLines = 200
+
+func scriptEnv(alert utils.Alert, metric utils.AlertMetricTrack) []string {
+	return []string{
+		"COSMOS_ALERT_NAME=" + alert.Name,
+		"COSMOS_ALERT_SEVERITY=" + alert.Severity,
+		"COSMOS_ALERT_METRIC=" + metric.Key,
+		"COSMOS_ALERT_OBJECT=" + metric.Object,
+		"COSMOS_ALERT_VALUE=" + strconv.Itoa(metric.Value),
+		"COSMOS_ALERT_MAX=" + strconv.FormatUint(metric.Max, 10),
+		"COSMOS_ALERT_OPERATOR=" + alert.Condition.Operator,
+		"COSMOS_ALERT_THRESHOLD=" + strconv.Itoa(alert.Condition.Value),
+		"COSMOS_ALERT_PERCENT=" + strconv.FormatBool(alert.Condition.Percent),
+	}
+}
+
+// RunAlertScript runs the action's command through the CRON one-time job
+// runner, on the host or inside action.Container, and blocks until it is done.
+// The command is killed when it runs longer than the action's timeout
+func RunAlertScript(alert utils.Alert, action utils.AlertAction, metric utils.AlertMetricTrack) {
+	timeout := scriptDefaultTimeout
+	if action.Timeout > 0 {
+		timeout = time.Duration(action.Timeout) * time.Second
+	}
+
+	env := scriptEnv(alert, metric)
+
+	job := cron.JobFromCommandWithEnv(env, "sh", "-c", action.Target)
+	if action.Container != "" {
+		job = cron.JobFromContainerCommandWithEnv(action.Container, env, "sh", "-c", action.Target)
+	}
+
+	output := []string{}
+	outputLock := sync.Mutex{}
+	started := time.Now()
+
+	cron.RunOneTimeJob(cron.ConfigJob{
+		Scheduler:   "Alerts",
+		Name:        "Alert script " + alert.Name,
+		Cancellable: true,
+		Container:   action.Container,
+		Job: func(OnLog func(string), OnFail func(error), OnSuccess func(), ctx context.Context, cancel context.CancelFunc) {
+			timeoutCtx, cancelTimeout := context.WithTimeout(ctx, timeout)
+			defer cancelTimeout()
+
+			job(
+				func(line string) {
+					outputLock.Lock()
+					if len(output) < scriptMaxOutputLines {
+						output = append(output, line)
+					} else if len(output) == scriptMaxOutputLines {
+						output = append(output, "[output truncated]")
+					}
+					outputLock.Unlock()
+
+					OnLog(line)
+				},
+				func(err error) {
+					if timeoutCtx.Err() == context.DeadlineExceeded {
+						err = errors.New("script timed out after " + timeout.String())
+					}
+
+					logScriptRun(alert, action, started, &output, &outputLock, err)
+					OnFail(err)
+				},
+				func() {
+					logScriptRun(alert, action, started, &output, &outputLock, nil)
+					OnSuccess()
+				},
+				timeoutCtx,
+				cancel,
+			)
+		},
+	})
+}
+
+func logScriptRun(alert utils.Alert, action utils.AlertAction, started time.Time, output *[]string, outputLock *sync.Mutex, err error) {
+	label := "Alert script succeeded"
+	level := "success"
+	errorMessage := ""
+
+	if err != nil {
+		label = "Alert script failed"
+		level = "error"
+		errorMessage = err.Error()
+	}
+
+	outputLock.Lock()
+	outputString := strings.Join(*output, "\n")
+	outputLock.Unlock()
+
+	object := ""
+	if action.Container != "" {
+		object = "container@" + action.Container
+	}
+
+	utils.TriggerEvent(
+		"cosmos.metrics.alert.script",
+		label,
+		level,
+		object,
+		map[string]interface{}{
+			"alert":     alert.Name,
+			"command":   action.Target,
+			"container": action.Container,
+			"duration":  time.Since(started).String(),
+			"output":    outputString,
+			"error":     errorMessage,
+		})
+}
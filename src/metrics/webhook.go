@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type WebhookPayload struct {
+	Alert     string    `json:"alert"`
+	State     string    `json:"state"`
+	Severity  string    `json:"severity"`
+	Metric    string    `json:"metric"`
+	Object    string    `json:"object"`
+	Value     int       `json:"value"`
+	Max       uint64    `json:"max"`
+	Operator  string    `json:"operator"`
+	Threshold int       `json:"threshold"`
+	Percent   bool      `json:"percent"`
+	Date      time.Time `json:"date"`
+}
+
+const webhookDefaultRetries = 3
+const webhookTimeout = 10 * time.Second
+
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+}
+
+func BuildWebhookBody(action utils.AlertAction, payload WebhookPayload) ([]byte, error) {
+	if action.Template == "" {
+		return json.Marshal(payload)
+	}
+
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		// escape a value so it can be embedded in a JSON string
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(action.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("webhook template did not produce valid JSON")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(action utils.AlertAction, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", action.Target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Cosmos-Webhook")
+
+	for key, value := range action.Headers {
+		req.Header.Set(key, value)
+	}
+
+	if action.Secret != "" {
+		req.Header.Set("X-Cosmos-Signature", SignWebhookBody(action.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("webhook returned status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return resp.StatusCode, nil
+}
+
+func SendWebhook(alert utils.Alert, action utils.AlertAction, metric utils.AlertMetricTrack, state string) {
+	payload := WebhookPayload{
+		Alert:     alert.Name,
+		State:     state,
+		Severity:  alert.Severity,
+		Metric:    metric.Key,
+		Object:    metric.Object,
+		Value:     metric.Value,
+		Max:       metric.Max,
+		Operator:  alert.Condition.Operator,
+		Threshold: alert.Condition.Value,
+		Percent:   alert.Condition.Percent,
+		Date:      time.Now(),
+	}
+
+	body, err := BuildWebhookBody(action, payload)
+	if err != nil {
+		utils.Error("Webhook: could not build payload for alert "+alert.Name, err)
+		logWebhookDelivery(alert, action, state, 0, 0, err)
+		return
+	}
+
+	retries := action.Retries
+	if retries <= 0 {
+		retries = webhookDefaultRetries
+	}
+
+	backoff := time.Second
+	status := 0
+	attempts := 0
+
+	for attempt := 1; attempt <= retries; attempt++ {
+		attempts = attempt
+		status, err = postWebhook(action, body)
+
+		if err == nil {
+			utils.Debug("Webhook: delivered alert " + alert.Name + " to " + action.Target)
+			logWebhookDelivery(alert, action, state, attempt, status, nil)
+			return
+		}
+
+		utils.Warn(fmt.Sprintf("Webhook: attempt %d/%d to %s failed: %s", attempt, retries, action.Target, err.Error()))
+
+		// client errors will not get better by retrying
+		if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			break
+		}
+
+		if attempt < retries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	utils.Error("Webhook: could not deliver alert "+alert.Name+" to "+action.Target, err)
+	logWebhookDelivery(alert, action, state, attempts, status, err)
+}
+
+func logWebhookDelivery(alert utils.Alert, action utils.AlertAction, state string, attempts int, status int, err error) {
+	label := "Webhook delivered"
+	level := "success"
+	errorMessage := ""
+
+	if err != nil {
+		label = "Webhook delivery failed"
+		level = "error"
+		errorMessage = err.Error()
+	}
+
+	utils.TriggerEvent(
+		"cosmos.metrics.alert.webhook",
+		label,
+		level,
+		"",
+		map[string]interface{}{
+			"alert":    alert.Name,
+			"state":    state,
+			"target":   action.Target,
+			"attempts": attempts,
+			"status":   status,
+			"error":    errorMessage,
+		})
+}
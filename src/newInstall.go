@@ -35,6 +35,11 @@ type NewInstallJSON struct {
 	UseWildcardCertificate bool `json:"useWildcardCertificate",validate:"omitempty"`
 	DNSChallengeProvider string `json:"dnsChallengeProvider",validate:"omitempty"`
 	DNSChallengeConfig map[string]string
+	ACMEDirectoryURL string `json:"acmeDirectoryURL"`
+	ACMEEABKeyID string `json:"acmeEABKeyID"`
+	ACMEEABHMACKey string `json:"acmeEABHMACKey"`
+	ACMECABundle string `json:"acmeCABundle"`
+	ACMEChallenge string `json:"acmeChallenge"`
 	AllowHTTPLocalIPAccess bool `json:"allowHTTPLocalIPAccess",validate:"omitempty"`
 }
 
@@ -129,6 +134,11 @@ func NewInstallRoute(w http.ResponseWriter, req *http.Request) {
 			newConfig.HTTPConfig.UseWildcardCertificate = request.UseWildcardCertificate
 			newConfig.HTTPConfig.DNSChallengeProvider = request.DNSChallengeProvider
 			newConfig.HTTPConfig.DNSChallengeConfig = request.DNSChallengeConfig
+			newConfig.HTTPConfig.ACMEDirectoryURL = request.ACMEDirectoryURL
+			newConfig.HTTPConfig.ACMEEABKeyID = request.ACMEEABKeyID
+			newConfig.HTTPConfig.ACMEEABHMACKey = request.ACMEEABHMACKey
+			newConfig.HTTPConfig.ACMECABundle = request.ACMECABundle
+			newConfig.HTTPConfig.ACMEChallenge = request.ACMEChallenge
 			newConfig.HTTPConfig.TLSCert = request.TLSCert
 			newConfig.HTTPConfig.TLSKey = request.TLSKey
 			newConfig.HTTPConfig.AllowHTTPLocalIPAccess = request.AllowHTTPLocalIPAccess
@@ -4,75 +4,182 @@ import (
     "io"
     "net"
     "sync"
+    "sync/atomic"
     "strings"
     "strconv"
+    "context"
+    "time"
 
     "github.com/madejackson/cosmos-server/src/utils"
+    "github.com/madejackson/cosmos-server/src/metrics"
 )
 
+const defaultInternalProxyDrainTimeout = 30 * time.Second
+
+type internalProxy struct {
+    port        string
+    target      string
+    listener    net.Listener
+    connections int64
+    bytes       int64
+    // stop accepting connections
+    cancel      context.CancelFunc
+    // force close the remaining connections
+    kill        context.CancelFunc
+    killCtx     context.Context
+}
+
+type InternalProxyStatus struct {
+    Target      string
+    Connections int64
+    Bytes       int64
+}
+
 var (
-    activeProxies map[string]chan bool
+    activeProxies map[string]*internalProxy
     proxiesLock   sync.Mutex
 )
 
-func GetActiveProxies() map[string]chan bool {
-    return activeProxies
+func GetActiveProxies() map[string]InternalProxyStatus {
+    proxiesLock.Lock()
+    defer proxiesLock.Unlock()
+
+    status := map[string]InternalProxyStatus{}
+    for port, p := range activeProxies {
+        status[port] = InternalProxyStatus{
+            Target:      p.target,
+            Connections: atomic.LoadInt64(&p.connections),
+            Bytes:       atomic.LoadInt64(&p.bytes),
+        }
+    }
+
+    return status
+}
+
+func (p *internalProxy) pushMetrics(bytes int64) {
+    if utils.GetMainConfig().MonitoringDisabled {
+        return
+    }
+
+    metrics.PushSetMetric("proxy.internal.connections."+p.port, int(atomic.LoadInt64(&p.connections)), metrics.DataDef{
+        Max: 0,
+        Period: time.Second * 30,
+        Label: "Internal Proxy Connections " + p.port,
+        AggloType: "avg",
+        SetOperation: "max",
+    })
+
+    if bytes > 0 {
+        metrics.PushSetMetric("proxy.internal.bytes."+p.port, int(bytes), metrics.DataDef{
+            Max: 0,
+            Period: time.Second * 30,
+            Label: "Internal Proxy Transfered Bytes " + p.port,
+            AggloType: "sum",
+            SetOperation: "sum",
+            Unit: "B",
+        })
+    }
+}
+
+// stop closes the listener right away, and lets the open connections
+// finish for up to drainTimeout
+func (p *internalProxy) stop(drainTimeout time.Duration) {
+    p.cancel()
+    p.listener.Close()
+
+    if connections := atomic.LoadInt64(&p.connections); connections > 0 {
+        utils.Log("Network: draining " + strconv.FormatInt(connections, 10) + " connection(s) on port " + p.port + " for up to " + drainTimeout.String())
+    }
+
+    time.AfterFunc(drainTimeout, p.kill)
 }
 
-func handleClient(client net.Conn, server net.Conn, stop chan bool) {
+func (p *internalProxy) handleClient(client net.Conn) {
+    atomic.AddInt64(&p.connections, 1)
+    p.pushMetrics(0)
+
+    var bytes int64
+
+    defer func() {
+        atomic.AddInt64(&p.connections, -1)
+        atomic.AddInt64(&p.bytes, bytes)
+        p.pushMetrics(bytes)
+    }()
+
     defer client.Close()
+
+    server, err := net.DialTimeout("tcp", p.target, 10 * time.Second)
+    if err != nil {
+        utils.Error("Failed to connect to server " + p.target, err)
+        return
+    }
     defer server.Close()
 
-    // Forward data between client and server, and watch for stop signal
-    done := make(chan struct{})
+    // Forward data between client and server, and watch for the kill signal
+    done := make(chan int64, 2)
     go func() {
-        io.Copy(server, client)
-        done <- struct{}{}
+        n, _ := io.Copy(server, client)
+        done <- n
     }()
     go func() {
-        io.Copy(client, server)
-        done <- struct{}{}
+        n, _ := io.Copy(client, server)
+        done <- n
     }()
 
+    finished := 0
     select {
-    case <-stop:
-        return
-    case <-done:
-        return
+    case <-p.killCtx.Done():
+    case n := <-done:
+        bytes += n
+        finished++
+    }
+
+    client.Close()
+    server.Close()
+
+    for ; finished < 2; finished++ {
+        bytes += <-done
     }
 }
 
-func startProxy(listenAddr string, target string, stop chan bool) {
+func startProxy(port string, target string) (*internalProxy, error) {
+    listenAddr := ":" + port
+
     listener, err := net.Listen("tcp", listenAddr)
     if err != nil {
-        utils.Error("Failed to listen on " + listenAddr, err)
-        return
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    killCtx, kill := context.WithCancel(context.Background())
+
+    p := &internalProxy{
+        port: port,
+        target: target,
+        listener: listener,
+        cancel: cancel,
+        kill: kill,
+        killCtx: killCtx,
     }
-    defer listener.Close()
 
     utils.Log("Proxy listening on "+listenAddr+", forwarding to " + target)
 
-    for {
-        select {
-        case <-stop:
-            return
-        default:
+    go func() {
+        for {
             client, err := listener.Accept()
             if err != nil {
-                utils.Error("Failed to accept connection: %v", err)
-                continue
-            }
-
-            server, err := net.Dial("tcp", target)
-            if err != nil {
-                utils.Error("Failed to connect to server: %v", err)
-                client.Close()
+                if ctx.Err() != nil {
+                    return
+                }
+                utils.Error("Failed to accept connection on " + listenAddr, err)
                 continue
             }
 
-            go handleClient(client, server, stop)
+            go p.handleClient(client)
         }
-    }
+    }()
+
+    return p, nil
 }
 
 type PortsPair struct {
@@ -86,20 +193,25 @@ func initInternalPortProxy(ports []PortsPair, destination string) {
 
     // Initialize activeProxies map if it's nil
     if activeProxies == nil {
-        activeProxies = make(map[string]chan bool)
+        activeProxies = make(map[string]*internalProxy)
+    }
+
+    drainTimeout := utils.GetMainConfig().HTTPConfig.InternalProxyDrainTimeout
+    if drainTimeout == 0 {
+        drainTimeout = defaultInternalProxyDrainTimeout
     }
 
-    // Stop any existing proxies that are not in the new list
-    for port, stop := range activeProxies {
+    // Stop any existing proxies that are not in the new list, or whose target changed
+    for port, p := range activeProxies {
         found := false
-        for _, p := range ports {
-            if p.From == port {
+        for _, pair := range ports {
+            if pair.From == port && destination+":"+pair.To == p.target {
                 found = true
                 break
             }
         }
         if !found {
-            close(stop)
+            p.stop(drainTimeout)
             delete(activeProxies, port)
         }
     }
@@ -108,9 +220,12 @@ func initInternalPortProxy(ports []PortsPair, destination string) {
     for _, port := range ports {
         if _, exists := activeProxies[port.From]; !exists {
             utils.Log("Network Starting internal proxy for port " + port.From)
-            stop := make(chan bool)
-            activeProxies[port.From] = stop
-            go startProxy(":"+port.From, destination+":"+port.To, stop)
+            p, err := startProxy(port.From, destination+":"+port.To)
+            if err != nil {
+                utils.Error("Failed to listen on :" + port.From, err)
+                continue
+            }
+            activeProxies[port.From] = p
         }
     }
 }
@@ -143,7 +258,7 @@ func InitInternalTCPProxy() {
 	}
 
 	for _, route := range routes {
-		if route.UseHost && strings.Contains(route.Host, ":") {
+		if route.UseHost && strings.Contains(route.Host, ":") && !IsStreamRoute(route) {
 			hostname := route.Host
 			port := strings.Split(hostname, ":")[1]
             // if port is a number
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type BanRequestJSON struct {
+	ClientID string `validate:"required"`
+	Type     string `validate:"required,oneof=ban allow"`
+	Reason   string
+}
+
+// strikes stay in memory, everything else is persisted
+func saveBan(ban *userBan) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "bans")
+	if errCo != nil {
+		utils.Error("SmartShield - Database Connect", errCo)
+		return
+	}
+
+	_, err := c.InsertOne(nil, ban)
+	if err != nil {
+		utils.Error("SmartShield - Error while saving ban for "+ban.ClientID, err)
+	}
+}
+
+func deleteBans(ids []primitive.ObjectID) {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "bans")
+	if errCo != nil {
+		utils.Error("SmartShield - Database Connect", errCo)
+		return
+	}
+
+	_, err := c.DeleteMany(nil, bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	})
+	if err != nil {
+		utils.Error("SmartShield - Error while deleting bans", err)
+	}
+}
+
+// LoadBans restores the persisted bans and allow-list entries after a restart
+func LoadBans() {
+	c, errCo := utils.GetCollection(utils.GetRootAppId(), "bans")
+	if errCo != nil {
+		utils.Error("SmartShield - Database Connect", errCo)
+		return
+	}
+
+	bans := []*userBan{}
+
+	cursor, err := c.Find(nil, bson.M{})
+	if err != nil {
+		utils.Error("SmartShield - Error while loading bans", err)
+		return
+	}
+	defer cursor.Close(nil)
+
+	if err = cursor.All(nil, &bans); err != nil {
+		utils.Error("SmartShield - Error while decoding bans", err)
+		return
+	}
+
+	shield.Lock()
+	defer shield.Unlock()
+
+	loaded := 0
+	for _, ban := range bans {
+		if !ban.IsExpired() {
+			shield.bans = append(shield.bans, ban)
+			loaded++
+		}
+	}
+
+	utils.Log("SmartShield: Loaded " + strconv.Itoa(loaded) + " bans")
+}
+
+func GetActiveBans() []userBan {
+	shield.Lock()
+	defer shield.Unlock()
+
+	bans := []userBan{}
+	for _, ban := range shield.bans {
+		if ban.IsActive() && !ban.IsExpired() {
+			bans = append(bans, *ban)
+		}
+	}
+
+	return bans
+}
+
+// LiftBan removes every ban, strike and allow-list entry of this client
+func LiftBan(clientID string) int {
+	shield.Lock()
+
+	count := 0
+	removed := []primitive.ObjectID{}
+	for i := len(shield.bans) - 1; i >= 0; i-- {
+		ban := shield.bans[i]
+		if ban.ClientID == clientID {
+			shield.bans = append(shield.bans[:i], shield.bans[i+1:]...)
+			count++
+			if ban.BanType != STRIKE {
+				removed = append(removed, ban.ID)
+			}
+		}
+	}
+
+	shield.Unlock()
+
+	if len(removed) > 0 {
+		deleteBans(removed)
+	}
+
+	utils.ResetIPAbuseCounter(clientID)
+
+	return count
+}
+
+func isValidBanClientID(clientID string) bool {
+	if _, _, err := net.ParseCIDR(clientID); err == nil {
+		return true
+	}
+	return net.ParseIP(clientID) != nil
+}
+
+func BansRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   GetActiveBans(),
+		})
+	} else if req.Method == "POST" {
+		var request BanRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			utils.Error("SmartShieldBan: Invalid Request", err)
+			utils.HTTPError(w, "Invalid Request", http.StatusBadRequest, "SS001")
+			return
+		}
+
+		errV := utils.Validate.Struct(request)
+		if errV != nil {
+			utils.Error("SmartShieldBan: Invalid Request", errV)
+			utils.HTTPError(w, "Invalid Request: "+errV.Error(), http.StatusBadRequest, "SS001")
+			return
+		}
+
+		request.ClientID = utils.SanitizeSafe(request.ClientID)
+
+		if !isValidBanClientID(request.ClientID) {
+			utils.Error("SmartShieldBan: Invalid IP "+request.ClientID, nil)
+			utils.HTTPError(w, "Invalid IP or CIDR: "+request.ClientID, http.StatusBadRequest, "SS002")
+			return
+		}
+
+		banType := PERM
+		if request.Type == "allow" {
+			banType = ALLOW
+		}
+
+		ban := &userBan{
+			ID:       primitive.NewObjectID(),
+			ClientID: request.ClientID,
+			BanType:  banType,
+			Time:     time.Now(),
+			Reason:   utils.SanitizeSafe(request.Reason),
+			Manual:   true,
+		}
+
+		shield.Lock()
+		shield.bans = append(shield.bans, ban)
+		shield.Unlock()
+
+		saveBan(ban)
+
+		utils.TriggerEvent(
+			"cosmos.proxy.shield.ban."+request.Type,
+			"SmartShield manual "+request.Type+" for "+request.ClientID,
+			"important",
+			"",
+			map[string]interface{}{
+				"clientID": request.ClientID,
+				"reason":   ban.Reason,
+				"user":     req.Header.Get("x-cosmos-user"),
+			})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   ban,
+		})
+	} else if req.Method == "DELETE" {
+		clientID := req.URL.Query().Get("clientID")
+		if clientID == "" {
+			utils.Error("SmartShieldBan: Missing clientID", nil)
+			utils.HTTPError(w, "Missing clientID", http.StatusBadRequest, "SS001")
+			return
+		}
+
+		removed := LiftBan(clientID)
+
+		utils.TriggerEvent(
+			"cosmos.proxy.shield.ban.lift",
+			"SmartShield ban lifted for "+clientID,
+			"important",
+			"",
+			map[string]interface{}{
+				"clientID": clientID,
+				"user":     req.Header.Get("x-cosmos-user"),
+			})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "OK",
+			"removed": removed,
+		})
+	} else {
+		utils.Error("SmartShieldBan: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/madejackson/cosmos-server/src/metrics"
+	"github.com/madejackson/cosmos-server/src/utils"
 )
 
 var botUserAgents = []string{
@@ -31,6 +32,7 @@ func BotDetectionMiddleware(next http.Handler) http.Handler {
 		
 		if userAgent == "" {
 			go metrics.PushShieldMetrics("bots")
+			utils.MarkAccessLogShield(r, "bots")
 			http.Error(w, "Access denied: Bots are not allowed.", http.StatusForbidden)
 			return
 		}
@@ -38,6 +40,7 @@ func BotDetectionMiddleware(next http.Handler) http.Handler {
 		for _, botUserAgent := range botUserAgents {
 			if userAgent == botUserAgent {
 			go metrics.PushShieldMetrics("bots")
+			utils.MarkAccessLogShield(r, "bots")
 				http.Error(w, "Access denied: Bots are not allowed.", http.StatusForbidden)
 				return
 			}
@@ -9,13 +9,29 @@ import (
 func BuildFromConfig(router *mux.Router, config utils.ProxyConfig) *mux.Router {
 
 	router.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
+		// ?route=name reports the health check of that route instead
+		if routeName := r.URL.Query().Get("route"); routeName != "" {
+			health, ok := GetRouteHealth(routeName)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			if !health.Healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("DOWN"))
+				return
+			}
+		}
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
+	StartHealthChecks(config.Routes)
+
 	for i := len(config.Routes)-1; i >= 0; i-- {
 		routeConfig := config.Routes[i]
-		if !routeConfig.Disabled {
+		if !routeConfig.Disabled && !IsStreamRoute(routeConfig) {
 			RouterGen(routeConfig, router, RouteTo(routeConfig))
 		}
 	}
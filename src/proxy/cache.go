@@ -0,0 +1,505 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/metrics"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+func parseCacheControl(values []string) map[string]string {
+	directives := map[string]string{}
+
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+
+	return directives
+}
+
+func cacheControlSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	// websockets, partial content and credentials sent by the client itself
+	if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	_, noStore := parseCacheControl(r.Header.Values("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+// requestRefresh is true when the client asks for a response from the backend
+func requestRefresh(r *http.Request) bool {
+	directives := parseCacheControl(r.Header.Values("Cache-Control"))
+	_, noCache := directives["no-cache"]
+	maxAge, hasMaxAge := cacheControlSeconds(directives, "max-age")
+	return noCache || (hasMaxAge && maxAge == 0) || r.Header.Get("Pragma") == "no-cache"
+}
+
+// responseFreshness follows the rules of a shared cache: s-maxage, max-age, then Expires
+func responseFreshness(header http.Header, config utils.RouteCacheConfig) (time.Duration, time.Duration, bool) {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+
+	for _, forbidden := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[forbidden]; ok {
+			return 0, 0, false
+		}
+	}
+
+	fresh, ok := cacheControlSeconds(directives, "s-maxage")
+	if !ok {
+		fresh, ok = cacheControlSeconds(directives, "max-age")
+	}
+
+	if !ok && header.Get("Expires") != "" {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			// invalid dates mean already expired
+			return 0, 0, false
+		}
+
+		date := time.Now()
+		if parsed, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = parsed
+		}
+
+		fresh, ok = expires.Sub(date), true
+	}
+
+	if !ok {
+		fresh = config.DefaultTTL
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		fresh -= time.Duration(age) * time.Second
+	}
+
+	if fresh <= 0 {
+		return 0, 0, false
+	}
+
+	stale, ok := cacheControlSeconds(directives, "stale-while-revalidate")
+	if !ok {
+		stale = config.StaleWhileRevalidate
+	}
+
+	if _, ok := directives["must-revalidate"]; ok {
+		stale = 0
+	}
+
+	return fresh, stale, true
+}
+
+func cacheBaseKey(r *http.Request, route utils.ProxyRouteConfig) string {
+	key := r.Host + r.URL.RequestURI()
+	// the backend cannot tell its users apart otherwise
+	if route.AuthEnabled {
+		key += "\x00" + r.Header.Get("x-cosmos-user")
+	}
+	return key
+}
+
+func (cache *routeCache) variantKey(base string, r *http.Request) string {
+	cache.Lock()
+	vary := cache.vary[base]
+	cache.Unlock()
+
+	key := base
+	for _, name := range vary {
+		key += "\x00" + name + "=" + strings.Join(r.Header.Values(name), ",")
+	}
+	return key
+}
+
+func (cache *routeCache) objectLimit() int64 {
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.maxObject
+}
+
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	max      int64
+	overflow bool
+	// headers set by the middlewares before the backend answered
+	before http.Header
+}
+
+func (w *cacheRecorder) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(p)) > w.max {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.overflow = true
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *cacheRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *cacheRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// cacheDiscardWriter receives the responses of background revalidations
+type cacheDiscardWriter struct {
+	header http.Header
+}
+
+func (w *cacheDiscardWriter) Header() http.Header         { return w.header }
+func (w *cacheDiscardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *cacheDiscardWriter) WriteHeader(status int)      {}
+
+func (cache *routeCache) store(config utils.RouteCacheConfig, r *http.Request, base string, rec *cacheRecorder) {
+	if rec.overflow || !cacheableStatus[rec.status] {
+		return
+	}
+
+	header := http.Header{}
+	for name, values := range rec.Header() {
+		if before, ok := rec.before[name]; !ok || strings.Join(before, "\n") != strings.Join(values, "\n") {
+			header[name] = append([]string{}, values...)
+		}
+	}
+
+	if header.Get("Set-Cookie") != "" || strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+
+	fresh, stale, ok := responseFreshness(header, config)
+	if !ok {
+		return
+	}
+
+	vary := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	cache.Lock()
+	cache.vary[base] = vary
+	cache.Unlock()
+
+	body := append([]byte{}, rec.body.Bytes()...)
+
+	cache.put(&cacheEntry{
+		key:      cache.variantKey(base, r),
+		url:      r.URL.RequestURI(),
+		status:   rec.status,
+		header:   header,
+		body:     body,
+		size:     int64(len(body)),
+		storedAt: time.Now(),
+		freshFor: fresh,
+		staleFor: stale,
+	})
+}
+
+func (cache *routeCache) revalidate(config utils.RouteCacheConfig, r *http.Request, base string, key string, next http.Handler) {
+	cache.Lock()
+	if cache.revalidating[key] {
+		cache.Unlock()
+		return
+	}
+	cache.revalidating[key] = true
+	cache.Unlock()
+
+	// the client is already served, so the request must outlive it
+	req := r.Clone(context.Background())
+	limit := cache.objectLimit()
+
+	go func() {
+		defer func() {
+			cache.Lock()
+			delete(cache.revalidating, key)
+			cache.Unlock()
+		}()
+
+		rec := &cacheRecorder{
+			ResponseWriter: &cacheDiscardWriter{header: http.Header{}},
+			max:            limit,
+			before:         http.Header{},
+		}
+
+		next.ServeHTTP(rec, req)
+		cache.store(config, req, base, rec)
+	}()
+}
+
+func pushCacheMetric(route string, result string) {
+	if utils.GetMainConfig().MonitoringDisabled {
+		return
+	}
+
+	metrics.PushSetMetric("proxy.all.cache."+result, 1, metrics.DataDef{
+		Max:          0,
+		Period:       time.Second * 30,
+		Label:        "Global Cache " + result,
+		AggloType:    "sum",
+		SetOperation: "sum",
+	})
+	metrics.PushSetMetric("proxy.route.cache."+result+"."+route, 1, metrics.DataDef{
+		Max:          0,
+		Period:       time.Second * 30,
+		Label:        "Cache " + result + " " + route,
+		AggloType:    "sum",
+		SetOperation: "sum",
+		Object:       "route@" + route,
+	})
+}
+
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, body []byte, result string) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(entry.age(time.Now()).Seconds())))
+	w.Header().Set("X-Cache", result)
+
+	if etag := entry.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.status)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// CacheMiddleware serves the responses of the backend from the cache of the route while they are fresh
+func CacheMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	config := route.Cache
+
+	return func(next http.Handler) http.Handler {
+		if !config.Enabled {
+			return next
+		}
+
+		cache := getRouteCache(route.Name, config)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !cacheableRequest(r) {
+				w.Header().Set("X-Cache", "BYPASS")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			base := cacheBaseKey(r, route)
+			key := cache.variantKey(base, r)
+			now := time.Now()
+
+			if !requestRefresh(r) {
+				entry, body := cache.get(key)
+
+				if entry != nil && (entry.isFresh(now) || entry.isUsableStale(now)) {
+					cache.Lock()
+					cache.hits++
+					cache.Unlock()
+					go pushCacheMetric(route.Name, "hit")
+
+					if entry.isFresh(now) {
+						serveCacheEntry(w, r, entry, body, "HIT")
+					} else {
+						serveCacheEntry(w, r, entry, body, "STALE")
+						cache.revalidate(config, r, base, key, next)
+					}
+					return
+				}
+			}
+
+			cache.Lock()
+			cache.misses++
+			cache.Unlock()
+			go pushCacheMetric(route.Name, "miss")
+
+			w.Header().Set("X-Cache", "MISS")
+
+			// the body of HEAD requests cannot be cached
+			if r.Method == "HEAD" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &cacheRecorder{
+				ResponseWriter: w,
+				max:            cache.objectLimit(),
+				before:         w.Header().Clone(),
+			}
+
+			next.ServeHTTP(rec, r)
+			cache.store(config, r, base, rec)
+		})
+	}
+}
+
+type CachePurgeRequestJSON struct {
+	// every route when empty
+	Route string
+	// regexp on the path and query of the URLs, everything when empty
+	Pattern string
+}
+
+func CacheRoute(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		routeCaches.Lock()
+		caches := []*routeCache{}
+		for _, cache := range routeCaches.caches {
+			caches = append(caches, cache)
+		}
+		routeCaches.Unlock()
+
+		stats := []CacheStats{}
+		for _, cache := range caches {
+			stats = append(stats, cache.stats())
+		}
+
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Route < stats[j].Route })
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   stats,
+		})
+	} else if req.Method == "POST" {
+		var request CachePurgeRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			utils.Error("CachePurge: Invalid Request", err)
+			utils.HTTPError(w, "Invalid Request", http.StatusBadRequest, "CA001")
+			return
+		}
+
+		var pattern *regexp.Regexp
+		if request.Pattern != "" {
+			pattern, err = regexp.Compile(request.Pattern)
+			if err != nil {
+				utils.Error("CachePurge: Invalid Pattern", err)
+				utils.HTTPError(w, "Invalid Pattern: "+err.Error(), http.StatusBadRequest, "CA001")
+				return
+			}
+		}
+
+		routeCaches.Lock()
+		caches := []*routeCache{}
+		for name, cache := range routeCaches.caches {
+			if request.Route == "" || request.Route == name {
+				caches = append(caches, cache)
+			}
+		}
+		routeCaches.Unlock()
+
+		if request.Route != "" && len(caches) == 0 {
+			utils.HTTPError(w, "No cache for route "+request.Route, http.StatusNotFound, "CA002")
+			return
+		}
+
+		purged := 0
+		for _, cache := range caches {
+			purged += cache.purge(pattern)
+		}
+
+		utils.TriggerEvent(
+			"cosmos.proxy.cache.purge",
+			"Cache purged",
+			"info",
+			"",
+			map[string]interface{}{
+				"route":   request.Route,
+				"pattern": request.Pattern,
+				"purged":  purged,
+				"user":    req.Header.Get("x-cosmos-user"),
+			})
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data": map[string]interface{}{
+				"purged": purged,
+			},
+		})
+	} else {
+		utils.Error("CacheRoute: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type cacheEntry struct {
+	key    string
+	url    string
+	status int
+	header http.Header
+	// nil once spilled to disk
+	body []byte
+	size int64
+
+	storedAt time.Time
+	freshFor time.Duration
+	staleFor time.Duration
+
+	onDisk bool
+	// being written to disk, in none of the lists
+	spilling bool
+	file     string
+	element  *list.Element
+}
+
+func (entry *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(entry.storedAt)
+}
+
+func (entry *cacheEntry) isFresh(now time.Time) bool {
+	return entry.age(now) < entry.freshFor
+}
+
+func (entry *cacheEntry) isUsableStale(now time.Time) bool {
+	return entry.age(now) < entry.freshFor+entry.staleFor
+}
+
+type CacheStats struct {
+	Route       string `json:"route"`
+	Entries     int    `json:"entries"`
+	MemoryBytes int64  `json:"memoryBytes"`
+	DiskBytes   int64  `json:"diskBytes"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+}
+
+// routeCache keeps the most recently used bodies in memory and moves the
+// older ones to CONFIGFOLDER/cache/<route> when a disk size is set
+type routeCache struct {
+	sync.Mutex
+	route   string
+	entries map[string]*cacheEntry
+	// the Vary headers learnt per URL
+	vary map[string][]string
+
+	memory      *list.List
+	memoryBytes int64
+	maxMemory   int64
+
+	disk      *list.List
+	diskBytes int64
+	maxDisk   int64
+
+	maxObject    int64
+	revalidating map[string]bool
+
+	// files of the removed entries, deleted by unlock
+	unlinks []string
+	// makes the file of each spilled entry unique
+	spilled int64
+
+	hits   int64
+	misses int64
+}
+
+var routeCaches = struct {
+	sync.Mutex
+	caches map[string]*routeCache
+}{caches: map[string]*routeCache{}}
+
+func cacheFolder(route string) string {
+	sum := sha256.Sum256([]byte(route))
+	return utils.CONFIGFOLDER + "cache/" + hex.EncodeToString(sum[:8]) + "/"
+}
+
+// getRouteCache keeps the cache of a route across router rebuilds, with the new limits
+func getRouteCache(route string, config utils.RouteCacheConfig) *routeCache {
+	routeCaches.Lock()
+	defer routeCaches.Unlock()
+
+	cache, ok := routeCaches.caches[route]
+	if !ok {
+		// the index of the previous run is lost
+		os.RemoveAll(cacheFolder(route))
+
+		cache = &routeCache{
+			route:        route,
+			entries:      map[string]*cacheEntry{},
+			vary:         map[string][]string{},
+			memory:       list.New(),
+			disk:         list.New(),
+			revalidating: map[string]bool{},
+		}
+		routeCaches.caches[route] = cache
+	}
+
+	maxMemory := int64(config.MaxMemory)
+	if maxMemory == 0 {
+		maxMemory = 64
+	}
+
+	maxObject := int64(config.MaxObjectSize)
+	if maxObject == 0 {
+		maxObject = 8
+	}
+
+	cache.Lock()
+	cache.maxMemory = maxMemory * 1024 * 1024
+	cache.maxDisk = int64(config.MaxDisk) * 1024 * 1024
+	cache.maxObject = maxObject * 1024 * 1024
+	spill := cache.evict()
+	cache.unlock()
+
+	cache.spill(spill)
+
+	return cache
+}
+
+// unlock releases the lock, then deletes the files of the removed entries,
+// the disk is never used with the lock held so hits do not wait for it
+func (cache *routeCache) unlock() {
+	unlinks := cache.unlinks
+	cache.unlinks = nil
+	cache.Unlock()
+
+	for _, file := range unlinks {
+		os.Remove(file)
+	}
+}
+
+// get returns the entry and its body, reading it from disk if needed
+func (cache *routeCache) get(key string) (*cacheEntry, []byte) {
+	cache.Lock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		cache.unlock()
+		return nil, nil
+	}
+
+	if !entry.onDisk {
+		// a spilling entry keeps its body until it is written
+		if !entry.spilling {
+			cache.memory.MoveToFront(entry.element)
+		}
+		body := entry.body
+		cache.unlock()
+		return entry, body
+	}
+
+	file := entry.file
+	cache.unlock()
+
+	body, err := os.ReadFile(file)
+
+	cache.Lock()
+	defer cache.unlock()
+
+	// removed or replaced while reading
+	if cache.entries[key] != entry {
+		if err != nil {
+			return nil, nil
+		}
+		return entry, body
+	}
+
+	if err != nil {
+		utils.Error("Cache: cannot read "+entry.url+" of route "+cache.route+" from disk", err)
+		cache.remove(entry)
+		return nil, nil
+	}
+
+	cache.disk.MoveToFront(entry.element)
+	return entry, body
+}
+
+func (cache *routeCache) put(entry *cacheEntry) {
+	cache.Lock()
+
+	if entry.size > cache.maxObject || entry.size > cache.maxMemory {
+		cache.unlock()
+		return
+	}
+
+	if previous, ok := cache.entries[entry.key]; ok {
+		cache.remove(previous)
+	}
+
+	entry.element = cache.memory.PushFront(entry)
+	cache.entries[entry.key] = entry
+	cache.memoryBytes += entry.size
+
+	spill := cache.evict()
+	cache.unlock()
+
+	cache.spill(spill)
+}
+
+// remove must be called with the lock held, the file is deleted by unlock
+func (cache *routeCache) remove(entry *cacheEntry) {
+	switch {
+	case entry.spilling:
+		// spill deletes the file once written
+	case entry.onDisk:
+		cache.disk.Remove(entry.element)
+		cache.diskBytes -= entry.size
+		cache.unlinks = append(cache.unlinks, entry.file)
+	default:
+		cache.memory.Remove(entry.element)
+		cache.memoryBytes -= entry.size
+	}
+
+	if cache.entries[entry.key] == entry {
+		delete(cache.entries, entry.key)
+	}
+}
+
+// evict must be called with the lock held, it returns the entries to write to disk with spill
+func (cache *routeCache) evict() []*cacheEntry {
+	spill := []*cacheEntry{}
+
+	for cache.memoryBytes > cache.maxMemory && cache.memory.Len() > 0 {
+		entry := cache.memory.Back().Value.(*cacheEntry)
+
+		if cache.maxDisk == 0 || entry.size > cache.maxDisk {
+			cache.remove(entry)
+			continue
+		}
+
+		cache.memory.Remove(entry.element)
+		cache.memoryBytes -= entry.size
+
+		cache.spilled++
+		sum := sha256.Sum256([]byte(entry.key))
+		entry.file = cacheFolder(cache.route) + hex.EncodeToString(sum[:]) + "-" + strconv.FormatInt(cache.spilled, 10)
+		entry.element = nil
+		entry.spilling = true
+		spill = append(spill, entry)
+	}
+
+	cache.evictDisk()
+
+	return spill
+}
+
+// evictDisk must be called with the lock held
+func (cache *routeCache) evictDisk() {
+	for cache.diskBytes > cache.maxDisk && cache.disk.Len() > 0 {
+		cache.remove(cache.disk.Back().Value.(*cacheEntry))
+	}
+}
+
+// spill writes the entries evicted from memory to disk, without the lock
+func (cache *routeCache) spill(entries []*cacheEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	written := make([]bool, len(entries))
+
+	if err := os.MkdirAll(cacheFolder(cache.route), 0700); err != nil {
+		utils.Error("Cache: cannot create the cache folder", err)
+	} else {
+		for i, entry := range entries {
+			// the body is not changed until spilling is over
+			if err := os.WriteFile(entry.file, entry.body, 0600); err != nil {
+				utils.Error("Cache: cannot write "+entry.url+" of route "+cache.route+" to disk", err)
+				continue
+			}
+			written[i] = true
+		}
+	}
+
+	cache.Lock()
+	defer cache.unlock()
+
+	for i, entry := range entries {
+		entry.spilling = false
+
+		if cache.entries[entry.key] != entry || !written[i] {
+			if cache.entries[entry.key] == entry {
+				delete(cache.entries, entry.key)
+			}
+			if written[i] {
+				cache.unlinks = append(cache.unlinks, entry.file)
+			}
+			continue
+		}
+
+		entry.body = nil
+		entry.onDisk = true
+		entry.element = cache.disk.PushFront(entry)
+		cache.diskBytes += entry.size
+	}
+
+	cache.evictDisk()
+}
+
+// purge removes the entries whose URL matches pattern, or all of them when it is nil
+func (cache *routeCache) purge(pattern *regexp.Regexp) int {
+	cache.Lock()
+	defer cache.unlock()
+
+	count := 0
+	for _, entry := range cache.entries {
+		if pattern == nil || pattern.MatchString(entry.url) {
+			cache.remove(entry)
+			count++
+		}
+	}
+
+	if pattern == nil {
+		cache.vary = map[string][]string{}
+	}
+
+	return count
+}
+
+func (cache *routeCache) stats() CacheStats {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return CacheStats{
+		Route:       cache.route,
+		Entries:     len(cache.entries),
+		MemoryBytes: cache.memoryBytes,
+		DiskBytes:   cache.diskBytes,
+		Hits:        cache.hits,
+		Misses:      cache.misses,
+	}
+}
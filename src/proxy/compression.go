@@ -0,0 +1,431 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+var defaultCompressionEncodings = []string{"br", "zstd", "gzip"}
+
+var defaultCompressionMimeTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"image/x-icon",
+	"font/ttf",
+	"font/otf",
+}
+
+// extensions of the precompressed files served by STATIC and SPA routes
+var precompressedExtensions = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+type compressionEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var compressionPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, 5)
+	}},
+	"zstd": {New: func() interface{} {
+		// browsers do not accept windows over 8MB
+		encoder, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return encoder
+	}},
+	"gzip": {New: func() interface{} {
+		encoder, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return encoder
+	}},
+}
+
+type compressionConfig struct {
+	encodings []string
+	mimeTypes []string
+	minSize   int
+}
+
+func newCompressionConfig(config utils.RouteCompressionConfig) compressionConfig {
+	compiled := compressionConfig{
+		encodings: []string{},
+		mimeTypes: config.MimeTypes,
+		minSize:   config.MinSize,
+	}
+
+	encodings := config.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultCompressionEncodings
+	}
+	for _, encoding := range encodings {
+		if _, ok := compressionPools[encoding]; ok {
+			compiled.encodings = append(compiled.encodings, encoding)
+		}
+	}
+
+	if len(compiled.mimeTypes) == 0 {
+		compiled.mimeTypes = defaultCompressionMimeTypes
+	}
+
+	if compiled.minSize == 0 {
+		compiled.minSize = 1024
+	}
+
+	return compiled
+}
+
+// negotiateEncoding picks the supported encoding with the best quality in
+// Accept-Encoding, our order of preference breaking the ties
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	qualities := map[string]float64{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		qualities[name] = quality
+	}
+
+	best := ""
+	bestQuality := 0.0
+	for _, encoding := range supported {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best = encoding
+			bestQuality = quality
+		}
+	}
+
+	return best
+}
+
+func (config compressionConfig) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	// compressed streams delay the events
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, pattern := range config.mimeTypes {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressionResponseWriter holds the first bytes back until it knows if the
+// response is worth compressing, then writes through the encoder
+type compressionResponseWriter struct {
+	http.ResponseWriter
+	config   compressionConfig
+	encoding string
+	head     bool
+
+	status  int
+	buffer  []byte
+	decided bool
+	encoder compressionEncoder
+}
+
+func (w *compressionResponseWriter) WriteHeader(status int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if status < 200 {
+		// informational responses, and the end of HTTP for upgrades
+		if status == http.StatusSwitchingProtocols {
+			w.decided = true
+		}
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if w.status == 0 {
+		w.status = status
+	}
+
+	if w.head || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.decide(true)
+	}
+}
+
+func (w *compressionResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if !w.decided {
+		w.buffer = append(w.buffer, p...)
+		if len(w.buffer) >= w.config.minSize {
+			if err := w.decide(false); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide can only tell if the body is too small once it is complete, as
+// streamed responses are flushed before reaching the minimum size
+func (w *compressionResponseWriter) decide(complete bool) error {
+	w.decided = true
+	header := w.ResponseWriter.Header()
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	// sniffed on the compressed bytes otherwise
+	if header.Get("Content-Type") == "" && len(w.buffer) > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buffer))
+	}
+
+	compressible := header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		w.config.compressible(header.Get("Content-Type"))
+
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if !compressible || w.encoding == "" || w.head || (complete && len(w.buffer) < w.config.minSize) ||
+		w.status == http.StatusNoContent || w.status == http.StatusNotModified || w.status == http.StatusPartialContent {
+		w.ResponseWriter.WriteHeader(w.status)
+		if len(w.buffer) > 0 {
+			_, err := w.ResponseWriter.Write(w.buffer)
+			w.buffer = nil
+			return err
+		}
+		return nil
+	}
+
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", w.encoding)
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.encoder = compressionPools[w.encoding].Get().(compressionEncoder)
+	w.encoder.Reset(w.ResponseWriter)
+
+	_, err := w.encoder.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
+
+func (w *compressionResponseWriter) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buffer) == 0 {
+			return
+		}
+		w.decide(true)
+	}
+
+	if w.encoder != nil {
+		if err := w.encoder.Close(); err != nil {
+			utils.Debug("Compression: " + err.Error())
+		}
+		w.encoder.Reset(io.Discard)
+		compressionPools[w.encoding].Put(w.encoder)
+		w.encoder = nil
+	}
+}
+
+func (w *compressionResponseWriter) Flush() {
+	if !w.decided {
+		// nothing to decide on yet
+		if len(w.buffer) == 0 {
+			return
+		}
+		w.decide(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressionResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.decided = true
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *compressionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CompressionMiddleware compresses the responses of the route with the best
+// encoding accepted by the client, unless the backend already did
+func CompressionMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	config := newCompressionConfig(route.Compression)
+
+	return func(next http.Handler) http.Handler {
+		if !route.Compression.Enabled || len(config.encodings) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressionResponseWriter{
+				ResponseWriter: w,
+				config:         config,
+				encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding"), config.encodings),
+				head:           r.Method == "HEAD",
+			}
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// PrecompressedMiddleware serves the .br and .gz files next to the files of
+// STATIC and SPA routes, when they exist and the client accepts them
+func PrecompressedMiddleware(route utils.ProxyRouteConfig, root string) func(http.Handler) http.Handler {
+	config := newCompressionConfig(route.Compression)
+
+	encodings := []string{}
+	for _, encoding := range config.encodings {
+		if _, ok := precompressedExtensions[encoding]; ok {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !route.Compression.Enabled || len(encodings) == 0 {
+			return next
+		}
+
+		fs := http.Dir(root)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			name := path.Clean("/" + r.URL.Path)
+
+			original, err := fs.Open(name)
+			isDir := false
+			if err == nil {
+				info, errS := original.Stat()
+				isDir = errS == nil && info.IsDir()
+				original.Close()
+			}
+
+			if err != nil || isDir {
+				if route.Mode == "SPA" {
+					name = "/index.html"
+				} else if isDir && strings.HasSuffix(r.URL.Path, "/") {
+					name = path.Join(name, "index.html")
+				} else {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			contentType := mime.TypeByExtension(path.Ext(name))
+			if contentType == "" || !config.compressible(contentType) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			// the next accepted encoding when a file is missing
+			remaining := encodings
+			for {
+				encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), remaining)
+				if encoding == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				others := []string{}
+				for _, other := range remaining {
+					if other != encoding {
+						others = append(others, other)
+					}
+				}
+				remaining = others
+
+				file, err := fs.Open(name + precompressedExtensions[encoding])
+				if err != nil {
+					continue
+				}
+
+				info, err := file.Stat()
+				if err != nil || info.IsDir() {
+					file.Close()
+					continue
+				}
+
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Content-Encoding", encoding)
+				http.ServeContent(w, r, name, info.ModTime(), file)
+				file.Close()
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	HEADER_RULE_SET     = "set"
+	HEADER_RULE_ADD     = "add"
+	HEADER_RULE_REMOVE  = "remove"
+	HEADER_RULE_REPLACE = "replace"
+)
+
+type headerRule struct {
+	utils.HeaderRule
+	pattern *regexp.Regexp
+	// only set when the header is missing, for the hardening
+	ifMissing bool
+	// only applied on HTTPS requests
+	httpsOnly bool
+}
+
+func compileHeaderRules(route utils.ProxyRouteConfig, direction string) []headerRule {
+	rules := []headerRule{}
+
+	for _, rule := range route.HeaderRules {
+		if rule.Direction != direction {
+			continue
+		}
+
+		compiled := headerRule{HeaderRule: rule}
+
+		if rule.Action == HEADER_RULE_REPLACE {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				utils.Error("Header rules: invalid pattern for "+rule.Name+" in route "+route.Name, err)
+				continue
+			}
+			compiled.pattern = pattern
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	return rules
+}
+
+// legacyHeaderRules turns OverwriteHostHeader and SpoofHostname into request rules,
+// DisableHeaderHardening is in legacyResponseHeaderRules
+func legacyHeaderRules(route utils.ProxyRouteConfig) []headerRule {
+	hostname := utils.GetMainConfig().HTTPConfig.Hostname
+	if route.Host != "" && route.UseHost {
+		hostname = route.Host
+	}
+
+	if route.OverwriteHostHeader != "" {
+		hostname = route.OverwriteHostHeader
+	}
+
+	host, port, _ := strings.Cut(hostname, ":")
+
+	rules := []headerRule{
+		{HeaderRule: utils.HeaderRule{Direction: "request", Action: HEADER_RULE_SET, Name: "X-Forwarded-Host", Value: host}},
+	}
+
+	if port != "" {
+		rules = append(rules, headerRule{HeaderRule: utils.HeaderRule{Direction: "request", Action: HEADER_RULE_SET, Name: "X-Forwarded-Port", Value: port}})
+	}
+
+	if route.SpoofHostname {
+		rules = append(rules,
+			headerRule{HeaderRule: utils.HeaderRule{Direction: "request", Action: HEADER_RULE_REMOVE, Name: "X-Forwarded-Port"}},
+			headerRule{HeaderRule: utils.HeaderRule{Direction: "request", Action: HEADER_RULE_REMOVE, Name: "X-Forwarded-Host"}},
+			headerRule{HeaderRule: utils.HeaderRule{Direction: "request", Action: HEADER_RULE_SET, Name: "Host", Value: "{upstream_host}"}},
+		)
+	}
+
+	return rules
+}
+
+// legacyResponseHeaderRules turns the header hardening, unless DisableHeaderHardening, into
+// response rules, the security headers sent by the backend are kept
+func legacyResponseHeaderRules(route utils.ProxyRouteConfig) []headerRule {
+	if route.DisableHeaderHardening {
+		return []headerRule{}
+	}
+
+	hardening := func(name, value string) headerRule {
+		return headerRule{
+			HeaderRule: utils.HeaderRule{Direction: "response", Action: HEADER_RULE_SET, Name: name, Value: value},
+			ifMissing:  true,
+		}
+	}
+
+	// TODO: Add preload if we have a valid certificate
+	hsts := hardening("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	hsts.httpsOnly = true
+
+	return []headerRule{
+		hsts,
+		hardening("X-Content-Type-Options", "nosniff"),
+		hardening("X-XSS-Protection", "1; mode=block"),
+		hardening("Content-Security-Policy", "frame-ancestors 'self'"),
+		hardening("X-Served-By-Cosmos", "1"),
+	}
+}
+
+// isHTTPSRequest is read on each request, IsHTTPS is only set once the HTTPS server started
+func isHTTPSRequest(req *http.Request) bool {
+	return req.TLS != nil || utils.IsHTTPS
+}
+
+func headerRuleVariables(req *http.Request, route utils.ProxyRouteConfig) *strings.Replacer {
+	clientIP := utils.GetClientIP(req)
+
+	scheme := "http"
+	if isHTTPSRequest(req) {
+		scheme = "https"
+	}
+
+	return strings.NewReplacer(
+		"{client_ip}", clientIP,
+		"{user}", req.Header.Get("x-cosmos-user"),
+		"{client_subject}", req.Header.Get("x-cosmos-client-subject"),
+		"{route}", route.Name,
+		"{host}", req.Host,
+		"{upstream_host}", req.URL.Host,
+		"{method}", req.Method,
+		"{path}", req.URL.Path,
+		"{scheme}", scheme,
+	)
+}
+
+// applyHeaderRules returns the new Host when a rule set it
+func applyHeaderRules(header http.Header, rules []headerRule, variables *strings.Replacer, https bool) string {
+	host := ""
+
+	for _, rule := range rules {
+		if (rule.httpsOnly && !https) || (rule.ifMissing && len(header.Values(rule.Name)) > 0) {
+			continue
+		}
+
+		value := variables.Replace(rule.Value)
+
+		switch rule.Action {
+		case HEADER_RULE_SET:
+			if strings.EqualFold(rule.Name, "Host") {
+				host = value
+			}
+			header.Set(rule.Name, value)
+		case HEADER_RULE_ADD:
+			header.Add(rule.Name, value)
+		case HEADER_RULE_REMOVE:
+			header.Del(rule.Name)
+		case HEADER_RULE_REPLACE:
+			values := header.Values(rule.Name)
+			header.Del(rule.Name)
+			for _, v := range values {
+				header.Add(rule.Name, rule.pattern.ReplaceAllString(v, value))
+			}
+		}
+	}
+
+	return host
+}
+
+func applyRequestHeaderRules(req *http.Request, rules []headerRule, route utils.ProxyRouteConfig) {
+	if host := applyHeaderRules(req.Header, rules, headerRuleVariables(req, route), isHTTPSRequest(req)); host != "" {
+		req.Host = host
+	}
+}
+
+type headerRulesResponseWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	route   utils.ProxyRouteConfig
+	rules   []headerRule
+	applied bool
+}
+
+func (w *headerRulesResponseWriter) apply() {
+	if !w.applied {
+		w.applied = true
+		applyHeaderRules(w.ResponseWriter.Header(), w.rules, headerRuleVariables(w.req, w.route), isHTTPSRequest(w.req))
+	}
+}
+
+func (w *headerRulesResponseWriter) WriteHeader(status int) {
+	// informational responses are sent before the final headers
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRulesResponseWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerRulesResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *headerRulesResponseWriter) Flush() {
+	w.apply()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *headerRulesResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// HeaderRulesMiddleware applies the header hardening and the response rules of the route
+// on the final headers, so the rules can also override the hardening and the backend such as the CSP
+func HeaderRulesMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	rules := append(legacyResponseHeaderRules(route), compileHeaderRules(route, "response")...)
+
+	return func(next http.Handler) http.Handler {
+		if len(rules) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&headerRulesResponseWriter{
+				ResponseWriter: w,
+				req:            r,
+				route:          route,
+				rules:          rules,
+			}, r)
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/metrics"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type TargetHealth struct {
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Status  int    `json:"status"`
+	Latency int64  `json:"latency"`
+	Error   string `json:"error"`
+}
+
+type RouteHealth struct {
+	Route     string         `json:"route"`
+	Healthy   bool           `json:"healthy"`
+	LastCheck time.Time      `json:"lastCheck"`
+	Since     time.Time      `json:"since"`
+	Targets   []TargetHealth `json:"targets"`
+}
+
+var routesHealth = map[string]RouteHealth{}
+var routesHealthLock sync.Mutex
+var healthChecksCancel context.CancelFunc
+
+func GetRoutesHealth() map[string]RouteHealth {
+	routesHealthLock.Lock()
+	defer routesHealthLock.Unlock()
+
+	result := make(map[string]RouteHealth, len(routesHealth))
+	for name, health := range routesHealth {
+		result[name] = health
+	}
+
+	return result
+}
+
+func GetRouteHealth(name string) (RouteHealth, bool) {
+	routesHealthLock.Lock()
+	defer routesHealthLock.Unlock()
+
+	health, ok := routesHealth[name]
+	return health, ok
+}
+
+// IsRouteDown is false until the first check of the route completed
+func IsRouteDown(name string) bool {
+	health, ok := GetRouteHealth(name)
+	return ok && !health.Healthy
+}
+
+// StartHealthChecks stops the checks of the previous configuration and
+// starts one checker per route with HealthCheck enabled
+func StartHealthChecks(routes []utils.ProxyRouteConfig) {
+	routesHealthLock.Lock()
+	defer routesHealthLock.Unlock()
+
+	if healthChecksCancel != nil {
+		healthChecksCancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	healthChecksCancel = cancel
+
+	checked := map[string]bool{}
+
+	for _, route := range routes {
+		if route.Disabled || !route.HealthCheck.Enabled {
+			continue
+		}
+
+		if route.Mode != "SERVAPP" && route.Mode != "PROXY" {
+			continue
+		}
+
+		checked[route.Name] = true
+		go runHealthCheck(ctx, route)
+	}
+
+	for name := range routesHealth {
+		if !checked[name] {
+			delete(routesHealth, name)
+		}
+	}
+}
+
+func runHealthCheck(ctx context.Context, route utils.ProxyRouteConfig) {
+	interval := route.HealthCheck.Interval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+
+	client := &http.Client{
+		// a redirect is an answer, do not follow it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: route.AcceptInsecureHTTPSTarget},
+		},
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	checkRoute(ctx, client, route)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkRoute(ctx, client, route)
+		}
+	}
+}
+
+func healthCheckTargets(route utils.ProxyRouteConfig) []string {
+	targets := []string{route.Target}
+
+	for _, target := range route.Targets {
+		if !utils.StringArrayContains(targets, target.Target) {
+			targets = append(targets, target.Target)
+		}
+	}
+
+	return targets
+}
+
+func checkTarget(ctx context.Context, client *http.Client, route utils.ProxyRouteConfig, target string) TargetHealth {
+	result := TargetHealth{
+		Target: target,
+	}
+
+	timeout := route.HealthCheck.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	checkURL := target
+	if route.HealthCheck.Path != "" {
+		checkURL = singleJoiningSlash(target, route.HealthCheck.Path)
+	}
+
+	// same rule as the Director in NewProxy
+	if route.Mode == "SERVAPP" && (os.Getenv("HOSTNAME") == "" || utils.IsHostNetwork) {
+		checkURL, _ = utils.ResolveContainerURL(checkURL)
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, checkURL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if route.OverwriteHostHeader != "" {
+		req.Host = route.OverwriteHostHeader
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	result.Latency = time.Since(started).Milliseconds()
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.Status = resp.StatusCode
+
+	if route.HealthCheck.ExpectedStatus != 0 {
+		result.Healthy = resp.StatusCode == route.HealthCheck.ExpectedStatus
+	} else {
+		result.Healthy = resp.StatusCode < 500
+	}
+
+	if !result.Healthy && result.Error == "" {
+		result.Error = "unexpected status " + strconv.Itoa(resp.StatusCode)
+	}
+
+	return result
+}
+
+func checkRoute(ctx context.Context, client *http.Client, route utils.ProxyRouteConfig) {
+	now := time.Now()
+	health := RouteHealth{
+		Route:     route.Name,
+		LastCheck: now,
+		Since:     now,
+	}
+
+	for _, target := range healthCheckTargets(route) {
+		targetHealth := checkTarget(ctx, client, route, target)
+		health.Targets = append(health.Targets, targetHealth)
+		if targetHealth.Healthy {
+			health.Healthy = true
+		}
+	}
+
+	// configuration was reloaded while checking
+	if ctx.Err() != nil {
+		return
+	}
+
+	routesHealthLock.Lock()
+	previous, existed := routesHealth[route.Name]
+	if existed && previous.Healthy == health.Healthy {
+		health.Since = previous.Since
+	}
+	routesHealth[route.Name] = health
+	routesHealthLock.Unlock()
+
+	value := 0
+	if health.Healthy {
+		value = 100
+	}
+
+	metrics.PushSetMetric("proxy.route.health."+route.Name, value, metrics.DataDef{
+		Max:          100,
+		Period:       time.Second * 30,
+		Label:        "Health " + route.Name,
+		AggloType:    "avg",
+		SetOperation: "min",
+		Unit:         "%",
+		Object:       "route@" + route.Name,
+	})
+
+	if existed && previous.Healthy == health.Healthy {
+		return
+	}
+
+	// a route coming up for the first time is not news
+	if !existed && health.Healthy {
+		return
+	}
+
+	if health.Healthy {
+		utils.Log("Health check: route " + route.Name + " is back up")
+
+		utils.TriggerEvent(
+			"cosmos.proxy.health."+route.Name+".up",
+			"Route "+route.Name+" is up",
+			"success",
+			"route@"+route.Name,
+			map[string]interface{}{
+				"route":   route.Name,
+				"targets": health.Targets,
+			})
+	} else {
+		utils.Warn("Health check: route " + route.Name + " is down")
+
+		utils.TriggerEvent(
+			"cosmos.proxy.health."+route.Name+".down",
+			"Route "+route.Name+" is down",
+			"error",
+			"route@"+route.Name,
+			map[string]interface{}{
+				"route":   route.Name,
+				"targets": health.Targets,
+			})
+	}
+}
+
+const maintenancePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%TITLE%</title>
+<style>
+body { font-family: sans-serif; background: #1e1e1e; color: #ddd; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+div { text-align: center; max-width: 600px; padding: 20px; }
+</style>
+</head>
+<body>
+<div>
+<h1>%TITLE%</h1>
+<p>%MESSAGE%</p>
+</div>
+</body>
+</html>`
+
+// MaintenancePageMiddleware answers with a 503 page instead of proxying
+// while the health check of the route is failing
+func MaintenancePageMiddleware(route utils.ProxyRouteConfig) func(http.Handler) http.Handler {
+	message := route.HealthCheck.MaintenanceMessage
+	if message == "" {
+		message = "This service is currently unavailable. Please try again in a few minutes."
+	}
+
+	retryAfter := route.HealthCheck.Interval
+	if retryAfter == 0 {
+		retryAfter = 30 * time.Second
+	}
+
+	page := strings.NewReplacer(
+		"%TITLE%", html.EscapeString(route.Name+" is under maintenance"),
+		"%MESSAGE%", html.EscapeString(message),
+	).Replace(maintenancePage)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if IsRouteDown(route.Name) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(page))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const (
+	LB_ROUND_ROBIN = "ROUND_ROBIN"
+	LB_LEAST_CONN  = "LEAST_CONN"
+	LB_IP_HASH     = "IP_HASH"
+)
+
+type upstreamContextKey struct{}
+
+type upstream struct {
+	Target       string
+	URL          *url.URL
+	Weight       int
+	active       int
+	fails        int
+	ejectedUntil time.Time
+	// smooth weighted round robin
+	currentWeight int
+}
+
+type LoadBalancer struct {
+	sync.Mutex
+	route        utils.ProxyRouteConfig
+	strategy     string
+	maxFails     int
+	failCooldown time.Duration
+	upstreams    []*upstream
+	next         int
+	proxy        *httputil.ReverseProxy
+}
+
+func getUpstream(req *http.Request) *upstream {
+	if u, ok := req.Context().Value(upstreamContextKey{}).(*upstream); ok {
+		return u
+	}
+	return nil
+}
+
+// FNV alone barely changes the high bits for similar IPs
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func isUpstreamFailure(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// NewLoadBalancer spreads the requests of the route over Target and Targets,
+// proxy is expected to come from NewProxy so its Director follows the picked target
+func NewLoadBalancer(route utils.ProxyRouteConfig, proxy *httputil.ReverseProxy) *LoadBalancer {
+	lb := &LoadBalancer{
+		route:        route,
+		strategy:     route.LoadBalancing.Strategy,
+		maxFails:     route.LoadBalancing.MaxFails,
+		failCooldown: route.LoadBalancing.FailCooldown,
+		proxy:        proxy,
+	}
+
+	if lb.strategy == "" {
+		lb.strategy = LB_ROUND_ROBIN
+	}
+	if lb.maxFails == 0 {
+		lb.maxFails = 3
+	}
+	if lb.failCooldown == 0 {
+		lb.failCooldown = 30 * time.Second
+	}
+
+	targets := append([]utils.ProxyTarget{{Target: route.Target, Weight: 1}}, route.Targets...)
+
+	for _, target := range targets {
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		// listing Target again in Targets only sets its weight
+		duplicate := false
+		for _, existing := range lb.upstreams {
+			if existing.Target == target.Target {
+				existing.Weight = weight
+				duplicate = true
+			}
+		}
+		if duplicate {
+			continue
+		}
+
+		targetURL, err := url.Parse(target.Target)
+		if err != nil || targetURL.Host == "" {
+			utils.Error("Load Balancer: invalid target "+target.Target+" for route "+route.Name, err)
+			continue
+		}
+
+		lb.upstreams = append(lb.upstreams, &upstream{
+			Target: target.Target,
+			URL:    targetURL,
+			Weight: weight,
+		})
+	}
+
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if u := getUpstream(resp.Request); u != nil {
+			lb.report(u, !isUpstreamFailure(resp.StatusCode))
+		}
+
+		if modifyResponse != nil {
+			return modifyResponse(resp)
+		}
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if u := getUpstream(req); u != nil {
+			utils.Error("Load Balancer: "+route.Name+" target "+u.Target+" unreachable", err)
+			lb.report(u, false)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	return lb
+}
+
+func (lb *LoadBalancer) available() []*upstream {
+	now := time.Now()
+	healthy := []*upstream{}
+
+	for _, u := range lb.upstreams {
+		if u.ejectedUntil.Before(now) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	// better to try an ejected target than to fail right away
+	if len(healthy) == 0 {
+		return lb.upstreams
+	}
+
+	return healthy
+}
+
+func (lb *LoadBalancer) pick(req *http.Request) *upstream {
+	lb.Lock()
+	defer lb.Unlock()
+
+	candidates := lb.available()
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var picked *upstream
+
+	switch lb.strategy {
+	case LB_LEAST_CONN:
+		lb.next++
+		for i := range candidates {
+			u := candidates[(lb.next+i)%len(candidates)]
+			if picked == nil || u.active*picked.Weight < picked.active*u.Weight {
+				picked = u
+			}
+		}
+	case LB_IP_HASH:
+		// rendezvous hashing, so only the clients of an ejected
+		// target get moved to another one
+		clientID := GetClientID(req)
+		bestScore := math.Inf(-1)
+		for _, u := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(clientID + "|" + u.Target))
+			hash := (float64(mix64(h.Sum64())>>11) + 0.5) / float64(uint64(1)<<53)
+			score := -float64(u.Weight) / math.Log(hash)
+			if score > bestScore {
+				bestScore = score
+				picked = u
+			}
+		}
+	default:
+		total := 0
+		for _, u := range candidates {
+			u.currentWeight += u.Weight
+			total += u.Weight
+			if picked == nil || u.currentWeight > picked.currentWeight {
+				picked = u
+			}
+		}
+		picked.currentWeight -= total
+	}
+
+	picked.active++
+
+	return picked
+}
+
+func (lb *LoadBalancer) release(u *upstream) {
+	lb.Lock()
+	u.active--
+	lb.Unlock()
+}
+
+// report implements the passive health check, a target failing
+// MaxFails times in a row is ejected for FailCooldown
+func (lb *LoadBalancer) report(u *upstream, success bool) {
+	lb.Lock()
+
+	if success {
+		u.fails = 0
+		lb.Unlock()
+		return
+	}
+
+	u.fails++
+	if u.fails < lb.maxFails {
+		lb.Unlock()
+		return
+	}
+
+	u.fails = 0
+	u.ejectedUntil = time.Now().Add(lb.failCooldown)
+	lb.Unlock()
+
+	utils.Warn("Load Balancer: ejecting target " + u.Target + " of route " + lb.route.Name + " for " + lb.failCooldown.String())
+
+	utils.TriggerEvent(
+		"cosmos.proxy.loadbalancer.eject."+lb.route.Name,
+		"Load Balancer "+lb.route.Name+" ejected "+u.Target,
+		"warning",
+		"route@"+lb.route.Name,
+		map[string]interface{}{
+			"route":    lb.route.Name,
+			"target":   u.Target,
+			"failures": lb.maxFails,
+			"cooldown": lb.failCooldown.String(),
+		})
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u := lb.pick(req)
+	if u == nil {
+		utils.Error("Load Balancer: no valid target for route "+lb.route.Name, nil)
+		http.Error(w, "502 Bad Gateway. No target available for this route.", http.StatusBadGateway)
+		return
+	}
+	defer lb.release(u)
+
+	ctx := context.WithValue(req.Context(), upstreamContextKey{}, u)
+	lb.proxy.ServeHTTP(w, req.WithContext(ctx))
+}
@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/madejackson/cosmos-server/src/user"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+// RequestMatcher is a compiled MatchRule. Rules combine matchers with &&, || and !, ex:
+//
+//	Host("app.example.com") && (PathPrefix("/api") || Header("X-Api", "1")) && !ClientIP("10.0.0.0/8")
+type RequestMatcher func(req *http.Request) bool
+
+type matchToken struct {
+	kind  string
+	value string
+	pos   int
+}
+
+func tokenizeMatchRule(rule string) ([]matchToken, error) {
+	tokens := []matchToken{}
+
+	for i := 0; i < len(rule); {
+		c := rule[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '!':
+			tokens = append(tokens, matchToken{kind: string(c), pos: i})
+			i++
+		case strings.HasPrefix(rule[i:], "&&") || strings.HasPrefix(rule[i:], "||"):
+			tokens = append(tokens, matchToken{kind: rule[i : i+2], pos: i})
+			i += 2
+		case c == '"' || c == '\'' || c == '`':
+			end := strings.IndexByte(rule[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, matchToken{kind: "string", value: rule[i+1 : i+1+end], pos: i})
+			i += end + 2
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(rule) && (rule[i] == '_' || (rule[i] >= 'a' && rule[i] <= 'z') || (rule[i] >= 'A' && rule[i] <= 'Z') || (rule[i] >= '0' && rule[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, matchToken{kind: "ident", value: rule[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+type matchRuleParser struct {
+	tokens []matchToken
+	pos    int
+}
+
+func (p *matchRuleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].kind
+	}
+	return ""
+}
+
+func (p *matchRuleParser) expect(kind string) (matchToken, error) {
+	if p.pos >= len(p.tokens) {
+		return matchToken{}, fmt.Errorf("expected %s at the end of the rule", kind)
+	}
+	token := p.tokens[p.pos]
+	if token.kind != kind {
+		return token, fmt.Errorf("expected %s at %d", kind, token.pos)
+	}
+	p.pos++
+	return token, nil
+}
+
+func (p *matchRuleParser) parseOr() (RequestMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req *http.Request) bool { return l(req) || right(req) }
+	}
+
+	return left, nil
+}
+
+func (p *matchRuleParser) parseAnd() (RequestMatcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(req *http.Request) bool { return l(req) && right(req) }
+	}
+
+	return left, nil
+}
+
+func (p *matchRuleParser) parseUnary() (RequestMatcher, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool { return !inner(req) }, nil
+	case "(":
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	return p.parseCall()
+}
+
+func (p *matchRuleParser) parseCall() (RequestMatcher, error) {
+	name, err := p.expect("ident")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	args := []string{}
+	for p.peek() != ")" {
+		if len(args) > 0 {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expect("string")
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg.value)
+	}
+	p.pos++
+
+	matcher, err := newRequestMatcher(name.value, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %w", name.value, name.pos, err)
+	}
+
+	return matcher, nil
+}
+
+func requireArgs(args []string, min int, max int) error {
+	if len(args) < min {
+		return fmt.Errorf("expects at least %d argument(s)", min)
+	}
+	if max >= 0 && len(args) > max {
+		return fmt.Errorf("expects at most %d argument(s)", max)
+	}
+	return nil
+}
+
+func requestHostname(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func requestClientIP(req *http.Request) net.IP {
+	return net.ParseIP(utils.GetClientIP(req))
+}
+
+func newRequestMatcher(name string, args []string) (RequestMatcher, error) {
+	switch name {
+	case "Host":
+		if err := requireArgs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			host := requestHostname(req)
+			for _, pattern := range args {
+				pattern = strings.ToLower(pattern)
+				if host == pattern || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "Path", "PathPrefix":
+		if err := requireArgs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			for _, path := range args {
+				if req.URL.Path == path || (name == "PathPrefix" && strings.HasPrefix(req.URL.Path, path)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "PathRegex":
+		if err := requireArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			return re.MatchString(req.URL.Path)
+		}, nil
+
+	case "Method":
+		if err := requireArgs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			for _, method := range args {
+				if strings.EqualFold(req.Method, method) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "Header", "Query":
+		if err := requireArgs(args, 1, 2); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			var values []string
+			var present bool
+			if name == "Header" {
+				values, present = req.Header[http.CanonicalHeaderKey(args[0])]
+			} else {
+				values, present = req.URL.Query()[args[0]]
+			}
+			if len(args) == 1 {
+				return present
+			}
+			for _, value := range values {
+				if value == args[1] {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "HeaderRegex":
+		if err := requireArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			for _, value := range req.Header.Values(args[0]) {
+				if re.MatchString(value) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "ClientIP":
+		if err := requireArgs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		networks := []*net.IPNet{}
+		for _, arg := range args {
+			if !strings.Contains(arg, "/") {
+				if ip := net.ParseIP(arg); ip != nil && ip.To4() != nil {
+					arg += "/32"
+				} else {
+					arg += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+		return func(req *http.Request) bool {
+			ip := requestClientIP(req)
+			if ip == nil {
+				return false
+			}
+			for _, network := range networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "Authenticated", "Admin":
+		if err := requireArgs(args, 0, 0); err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool {
+			_, role, ok := user.GetTokenUser(req)
+			return ok && (name == "Authenticated" || role >= utils.ADMIN)
+		}, nil
+	}
+
+	return nil, errors.New("unknown matcher")
+}
+
+// ParseMatchRule compiles the MatchRule of a route
+func ParseMatchRule(rule string) (RequestMatcher, error) {
+	tokens, err := tokenizeMatchRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("empty rule")
+	}
+
+	parser := &matchRuleParser{tokens: tokens}
+
+	matcher, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s at %d", tokens[parser.pos].kind, tokens[parser.pos].pos)
+	}
+
+	return matcher, nil
+}
+
+// ValidateRouteMatching checks the MatchRule and PathRegex of a route before it is saved
+func ValidateRouteMatching(route utils.ProxyRouteConfig) error {
+	if route.MatchRule != "" {
+		if _, err := ParseMatchRule(route.MatchRule); err != nil {
+			return fmt.Errorf("invalid MatchRule for route %s: %w", route.Name, err)
+		}
+	}
+
+	if route.PathRegex != "" {
+		if _, err := regexp.Compile(route.PathRegex); err != nil {
+			return fmt.Errorf("invalid PathRegex for route %s: %w", route.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// pathRewriteMiddleware replaces the path with PathRewrite, which can use the groups of PathRegex
+func pathRewriteMiddleware(re *regexp.Regexp, rewrite string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := re.ReplaceAllString(r.URL.Path, rewrite)
+		if path == "" || path[0] != '/' {
+			path = "/" + path
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+
+		next.ServeHTTP(w, r2)
+	})
+}
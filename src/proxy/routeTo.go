@@ -50,15 +50,22 @@ func joinURLPath(a, b *url.URL) (path, rawpath string) {
 
 
 // NewProxy takes target host and creates a reverse proxy
-func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHardening bool, CORSOrigin string, route utils.ProxyRouteConfig) (*httputil.ReverseProxy, error) {
+func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, CORSOrigin string, route utils.ProxyRouteConfig) (*httputil.ReverseProxy, error) {
 	url, err := url.Parse(targetHost)
 	if err != nil {
 			return nil, err
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
+
+	requestHeaderRules := append(legacyHeaderRules(route), compileHeaderRules(route, "request")...)
 	
 	proxy.Director = func(req *http.Request) {
+		url := url
+		if upstream := getUpstream(req); upstream != nil {
+			url = upstream.URL
+		}
+
 		originalScheme := "http"
 		if utils.IsHTTPS {
 			originalScheme = "https"
@@ -97,48 +104,13 @@ func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHa
 		req.Header.Del("X-Forwarded-Port")
 		req.Header.Del("X-Forwarded-Host")
 
-		hostname := utils.GetMainConfig().HTTPConfig.Hostname
-		if route.Host != "" && route.UseHost {
-			hostname = route.Host
-		}
-
-		// if route.UsePathPrefix {
-		// 	hostname = hostname + route.PathPrefix
-		// }
-
-		hostDest := hostname
-		hostPort := ""
-		if route.OverwriteHostHeader != "" {
-			hostDest = route.OverwriteHostHeader
-		}
-
-		// split port
-		hostDestSplit := strings.Split(hostDest, ":")
-		hostDestNoPort := hostDest
-		if len(hostDestSplit) > 1 {
-			hostDestNoPort = hostDestSplit[0]
-			hostPort = hostDestSplit[1]
-		}
-
-		// req.Header.Set("Host", hostDest)
-		// req.Host = hostDest
-
-		req.Header.Set("X-Forwarded-Host", hostDestNoPort)
-		
-		if hostPort != "" {
-			req.Header.Set("X-Forwarded-Port", hostPort)
+		// only trusted proxies can pass on X-Forwarded-For, the peer IP is appended after this
+		if !utils.IsTrustedForwarder(req) {
+			req.Header.Del("X-Forwarded-For")
 		}
 
-		
-		// spoof hostname
-		if route.SpoofHostname {
-			req.Header.Del("X-Forwarded-Port")
-			req.Header.Del("X-Forwarded-Host")
-			req.Header.Del("host")
-			
-			req.Header.Set("Host", req.URL.Host)
-			req.Host = req.URL.Host
-		}
+		// forwarded host, SpoofHostname and the user's rules
+		applyRequestHeaderRules(req, requestHeaderRules, route)
 	}
 
 	if AcceptInsecureHTTPSTarget {
@@ -155,13 +127,6 @@ func NewProxy(targetHost string, AcceptInsecureHTTPSTarget bool, DisableHeaderHa
 			resp.Header.Del("Access-Control-Allow-Origin")
 			resp.Header.Del("Access-Control-Allow-Credentials")
 		}
-		
-		if !DisableHeaderHardening {
-			resp.Header.Del("Strict-Transport-Security")
-			resp.Header.Del("X-Content-Type-Options")
-			resp.Header.Del("Content-Security-Policy")
-			resp.Header.Del("X-XSS-Protection")
-		}
 
 		// if 502
 		if resp.StatusCode == 502 {
@@ -191,17 +156,32 @@ func RouteTo(route utils.ProxyRouteConfig) http.Handler {
 	}
 
   if(routeType == "SERVAPP" || routeType == "PROXY") {
-		proxy, err := NewProxy(destination, route.AcceptInsecureHTTPSTarget, route.DisableHeaderHardening, route.CORSOrigin, route)
+		proxy, err := NewProxy(destination, route.AcceptInsecureHTTPSTarget, route.CORSOrigin, route)
 		if err != nil {
 				utils.Error("Create Route", err)
+
+				// only this route fails, not the whole router
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					utils.HTTPError(w, "Invalid route target", http.StatusBadGateway, "HTTP010")
+				})
 		}
 
 		// create a handler function which uses the reverse proxy
-		return proxy
+		var handler http.Handler = proxy
+
+		if len(route.Targets) > 0 {
+			handler = NewLoadBalancer(route, proxy)
+		}
+
+		if route.HealthCheck.Enabled && route.HealthCheck.MaintenancePage {
+			handler = MaintenancePageMiddleware(route)(handler)
+		}
+
+		return handler
 	}  else if (routeType == "STATIC") {
-		return http.FileServer(http.Dir(destination))
+		return PrecompressedMiddleware(route, destination)(http.FileServer(http.Dir(destination)))
 	}  else if (routeType == "SPA") {
-		return utils.SPAHandler(destination)
+		return PrecompressedMiddleware(route, destination)(utils.SPAHandler(destination))
 	} else if(routeType == "REDIRECT") {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, destination, 302)
@@ -52,6 +52,47 @@ func tokenMiddleware(enabled bool, adminOnly bool) func(next http.Handler) http.
 	}
 }
 
+// clientCertMiddleware requires a client certificate signed by the CA of the route,
+// and forwards its subject to the backend
+func clientCertMiddleware(route utils.ProxyRouteConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !route.ClientCertAuth.Enabled {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Del("x-cosmos-client-subject")
+				r.Header.Del("x-cosmos-client-serial")
+				next.ServeHTTP(w, r)
+			})
+		}
+
+		pool, internal, errPool := utils.ClientCertificatePool(route.ClientCertAuth.CACert)
+		if errPool != nil {
+			utils.Error("Client certificate CA of route "+route.Name+" is invalid", errPool)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("x-cosmos-client-subject")
+			r.Header.Del("x-cosmos-client-serial")
+
+			if errPool != nil {
+				utils.HTTPError(w, "Client certificate authentication is misconfigured", http.StatusInternalServerError, "HTTP009")
+				return
+			}
+
+			cert, err := utils.VerifyClientCertificate(r.TLS, pool, internal)
+			if err != nil {
+				utils.Error("Route "+route.Name+": client certificate rejected for "+utils.GetClientIP(r), err)
+				utils.HTTPError(w, "A valid client certificate is required", http.StatusForbidden, "HTTP009")
+				return
+			}
+
+			r.Header.Set("x-cosmos-client-subject", cert.Subject.String())
+			r.Header.Set("x-cosmos-client-serial", cert.SerialNumber.Text(16))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination http.Handler) *mux.Route {
 	origin := router.NewRoute()
 
@@ -73,6 +114,41 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = http.StripPrefix(route.PathPrefix, destination)
 	}
 
+	if route.PathRegex != "" {
+		pathRegex, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			utils.Error("Invalid PathRegex for route "+route.Name, err)
+			// never match rather than matching too much
+			origin = origin.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool { return false })
+		} else {
+			origin = origin.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+				return pathRegex.MatchString(r.URL.Path)
+			})
+
+			if route.PathRewrite != "" {
+				destination = pathRewriteMiddleware(pathRegex, route.PathRewrite, destination)
+			}
+		}
+	}
+
+	if route.MatchRule != "" {
+		matcher, err := ParseMatchRule(route.MatchRule)
+		if err != nil {
+			utils.Error("Invalid MatchRule for route "+route.Name, err)
+			origin = origin.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool { return false })
+		} else {
+			origin = origin.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+				return matcher(r)
+			})
+		}
+	}
+
+	// outside of the rewrites, so entries are keyed and purged on the public URL
+	destination = CacheMiddleware(route)(destination)
+
+	// inside of SmartShield and the bandwith limit, so they count the compressed bytes
+	destination = CompressionMiddleware(route)(destination)
+
 	for filter := range route.AddionalFilters {
 		if route.AddionalFilters[filter].Type == "header" {
 			origin = origin.Headers(route.AddionalFilters[filter].Name, route.AddionalFilters[filter].Value)
@@ -127,8 +203,9 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 	if throttlePerMinute > 0 {
 		throtthleTime := time.Minute
 		destination = httprate.Limit(throttlePerMinute, throtthleTime,
-			httprate.WithKeyFuncs(httprate.KeyByIP),
+			httprate.WithKeyFuncs(utils.ClientIPRateLimitKey),
 			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+				utils.MarkAccessLogShield(r, "throttle")
 				utils.Error("Too many requests. Throttling", nil)
 				utils.HTTPError(w, "Too many requests",
 					http.StatusTooManyRequests, "HTTP003")
@@ -141,12 +218,19 @@ func RouterGen(route utils.ProxyRouteConfig, router *mux.Router, destination htt
 		destination = utils.BandwithLimiterMiddleware(route.MaxBandwith)(destination)
 	}
 
-	if !route.DisableHeaderHardening {
-		destination = utils.SetSecurityHeaders(destination)
-	}
+	// the header hardening and the response rules
+	destination = HeaderRulesMiddleware(route)(destination)
 
 	destination = tokenMiddleware(route.AuthEnabled, route.AdminOnly)(utils.CORSHeader(originCORS)((destination)))
 
+	destination = clientCertMiddleware(route)(destination)
+
+	routeHandler := destination
+	destination = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		utils.SetAccessLogRoute(r, route.Name)
+		routeHandler.ServeHTTP(w, r)
+	})
+
 	origin.Handler(destination)
 
 	utils.Log("Added route: [" + (string)(route.Mode) + "] " + route.Host + route.PathPrefix + " to " + route.Target + "")
@@ -5,9 +5,11 @@ import (
 	"time"
 	"net/http"
 	"fmt"
-	"net"
 	"math"
 	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/madejackson/cosmos-server/src/utils"
 	"github.com/madejackson/cosmos-server/src/metrics"
@@ -22,13 +24,38 @@ const (
 	STRIKE = 0
 	TEMP = 1
 	PERM = 2
+	ALLOW = 3
 )
+
 type userBan struct {
-	ClientID string
-	banType int
-	time time.Time
-	reason string
-	shieldID string
+	ID primitive.ObjectID `json:"id" bson:"_id"`
+	// IP or CIDR
+	ClientID string `json:"clientID" bson:"ClientID"`
+	BanType int `json:"banType" bson:"BanType"`
+	Time time.Time `json:"time" bson:"Time"`
+	// blocked until, zero means forever
+	Until time.Time `json:"until" bson:"Until"`
+	// forgotten after, zero means never
+	Expires time.Time `json:"expires" bson:"Expires"`
+	Reason string `json:"reason" bson:"Reason"`
+	ShieldID string `json:"shieldID" bson:"ShieldID"`
+	Manual bool `json:"manual" bson:"Manual"`
+}
+
+func (ban *userBan) Matches(ClientID string) bool {
+	if strings.Contains(ban.ClientID, "/") {
+		ok, _ := utils.IPInRange(ClientID, ban.ClientID)
+		return ok
+	}
+	return ban.ClientID == ClientID
+}
+
+func (ban *userBan) IsActive() bool {
+	return ban.Until.IsZero() || ban.Until.After(time.Now())
+}
+
+func (ban *userBan) IsExpired() bool {
+	return !ban.Expires.IsZero() && ban.Expires.Before(time.Now())
 }
 
 type smartShieldState struct {
@@ -56,6 +83,7 @@ func CleanUp() {
 	defer shield.Unlock()
 
 	shieldSize := len(shield.requests) + len(shield.bans)
+	expired := []primitive.ObjectID{}
 
 	for i := len(shield.requests) - 1; i >= 0; i-- {
 		request := shield.requests[i]
@@ -66,14 +94,18 @@ func CleanUp() {
 
 	for i := len(shield.bans) - 1; i >= 0; i-- {
 		ban := shield.bans[i]
-		if(ban.banType == TEMP && ban.time.Add(72 * 3600 * time.Second).Before(time.Now())) {
-			shield.bans = append(shield.bans[:i], shield.bans[i+1:]...)
-		}
-		if(ban.banType == STRIKE && ban.time.Add(72 * 3600 * time.Second).Before(time.Now())) {
+		if(ban.IsExpired()) {
 			shield.bans = append(shield.bans[:i], shield.bans[i+1:]...)
+			if ban.BanType != STRIKE {
+				expired = append(expired, ban.ID)
+			}
 		}
 	}
 
+	if len(expired) > 0 {
+		go deleteBans(expired)
+	}
+
 	utils.Log("SmartShield: Cleaned up " + fmt.Sprintf("%d", shieldSize - (len(shield.requests) + len(shield.bans))) + " items")
 }
 
@@ -142,7 +174,7 @@ func (shield *smartShieldState) GetLastBan(policy utils.SmartShieldPolicy, userC
 	// Check for bans
 	for i := len(shield.bans) - 1; i >= 0; i-- {
 		ban := shield.bans[i]
-		if ban.banType == STRIKE && ban.ClientID == ClientID {
+		if ban.BanType == STRIKE && ban.ClientID == ClientID {
 			return ban
 		}
 	}
@@ -162,6 +194,13 @@ func (shield *smartShieldState) isAllowedToReqest(shieldID string, policy utils.
 		 ClientID == "172.17.0.1" {
 		return true
 	}
+
+	// Allow-list entries win over everything else
+	for _, ban := range shield.bans {
+		if ban.BanType == ALLOW && ban.Matches(ClientID) {
+			return true
+		}
+	}
 	
 	nbTempBans := 0
 	nbStrikes := 0
@@ -170,41 +209,59 @@ func (shield *smartShieldState) isAllowedToReqest(shieldID string, policy utils.
 	for i := len(shield.bans) - 1; i >= 0; i-- {
 		ban := shield.bans[i]
 
-		if ban.banType == PERM && ban.ClientID == ClientID {
+		if !ban.Matches(ClientID) || ban.IsExpired() {
+			continue
+		}
+
+		if ban.BanType == PERM {
 			return false
-		} else if ban.banType == TEMP && ban.ClientID == ClientID {
-			if(ban.time.Add(4 * 3600 * time.Second).After(time.Now())) {
+		} else if ban.BanType == TEMP {
+			if(ban.IsActive()) {
 				return false
-			} else if (ban.time.Add(72 * 3600 * time.Second).After(time.Now())) {
-				nbTempBans++
 			}
-		} else if ban.banType == STRIKE && ban.ClientID == ClientID {
-			if(ban.time.Add(3600 * time.Second).After(time.Now())) {
+			nbTempBans++
+		} else if ban.BanType == STRIKE {
+			if(ban.IsActive()) {
 				return false
-			} else if (ban.time.Add(24 * 3600 * time.Second).After(time.Now())) {
+			} else if (ban.Time.Add(policy.StrikeWindow).After(time.Now())) {
 				nbStrikes++
 			}
 		}
 	}
 
+	now := time.Now()
+
 	// Check for new bans
 	if nbTempBans >= 3 {
 		// perm ban
-		shield.bans = append(shield.bans, &userBan{
+		ban := &userBan{
+			ID: primitive.NewObjectID(),
 			ClientID: ClientID,
-			banType: PERM,
-			time: time.Now(),
-		})
+			BanType: PERM,
+			Time: now,
+			Reason: fmt.Sprintf("%d temporary bans within %s", nbTempBans, policy.BanExpiry),
+			ShieldID: shieldID,
+		}
+		shield.bans = append(shield.bans, ban)
+		go saveBan(ban)
 
 		utils.Warn("User " + ClientID + " has been banned permanently: "+ fmt.Sprintf("%+v", userConsumed))
 		return false
 	} else if nbStrikes >= 3 {
 		// temp ban
-		shield.bans = append(shield.bans, &userBan{
+		ban := &userBan{
+			ID: primitive.NewObjectID(),
 			ClientID: ClientID,
-			banType: TEMP,
-			time: time.Now(),
-		})
+			BanType: TEMP,
+			Time: now,
+			Until: now.Add(policy.TempBanDuration),
+			Expires: now.Add(policy.BanExpiry),
+			Reason: fmt.Sprintf("%d strikes within %s", nbStrikes, policy.StrikeWindow),
+			ShieldID: shieldID,
+		}
+		shield.bans = append(shield.bans, ban)
+		go saveBan(ban)
+
 		utils.Warn("User " + ClientID + " has been banned temporarily: "+ fmt.Sprintf("%+v", userConsumed))
 		return false
 	}
@@ -215,11 +272,14 @@ func (shield *smartShieldState) isAllowedToReqest(shieldID string, policy utils.
 		 (userConsumed.Bytes > (policy.PerUserByteLimit * int64(policy.PolicyStrictness))) ||
 		 (userConsumed.Simultaneous > (policy.PerUserSimultaneous * policy.PolicyStrictness * 15)) {
 		shield.bans = append(shield.bans, &userBan{
+			ID: primitive.NewObjectID(),
 			ClientID: ClientID,
-			banType: STRIKE,
-			time: time.Now(),
-			reason: fmt.Sprintf("%+v out of %+v", userConsumed, policy),
-			shieldID: shieldID,
+			BanType: STRIKE,
+			Time: now,
+			Until: now.Add(policy.StrikeDuration),
+			Expires: now.Add(policy.BanExpiry),
+			Reason: fmt.Sprintf("%+v out of %+v", userConsumed, policy),
+			ShieldID: shieldID,
 		})
 		utils.Warn("User " + ClientID + " has received a strike: "+ fmt.Sprintf("%+v", userConsumed))
 		return false
@@ -281,18 +341,10 @@ func calculateLowestExhaustedPercentage(policy utils.SmartShieldPolicy, userCons
 }
 
 func GetClientID(r *http.Request) string {
-	// when using Docker we need to get the real IP
-	UseForwardedFor := utils.GetMainConfig().HTTPConfig.UseForwardedFor
-
-	if UseForwardedFor && r.Header.Get("x-forwarded-for") != "" {
-		ip, _, _ := net.SplitHostPort(r.Header.Get("x-forwarded-for"))
-		utils.Debug("SmartShield: Getting client ID " + ip)
-		return ip
-	} else {
-		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-		utils.Debug("SmartShield: Getting client ID " + ip)
-		return ip
-	}
+	// the real IP behind the trusted proxies
+	ip := utils.GetClientIP(r)
+	utils.Debug("SmartShield: Getting client ID " + ip)
+	return ip
 }
 
 func isPrivileged(req *http.Request, policy utils.SmartShieldPolicy) bool {
@@ -325,6 +377,18 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 		if(policy.PrivilegedGroups == 0) {
 			policy.PrivilegedGroups = utils.ADMIN
 		}
+		if(policy.StrikeDuration == 0) {
+			policy.StrikeDuration = 1 * time.Hour
+		}
+		if(policy.StrikeWindow == 0) {
+			policy.StrikeWindow = 24 * time.Hour
+		}
+		if(policy.TempBanDuration == 0) {
+			policy.TempBanDuration = 4 * time.Hour
+		}
+		if(policy.BanExpiry == 0) {
+			policy.BanExpiry = 72 * time.Hour
+		}
 	}
 
 	return func(next http.Handler) http.Handler {
@@ -385,6 +449,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 				retries := 50
 				if wayTooManyReq {
 					go metrics.PushShieldMetrics("smart-shield")
+					utils.MarkAccessLogShield(r, "smart-shield")
 					utils.Log("SmartShield: WAYYYY Too many users on the server. Aborting right away.")
 					http.Error(w, "Too many requests", http.StatusTooManyRequests)
 					return
@@ -396,6 +461,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 					retries--
 					if retries <= 0 {
 						go metrics.PushShieldMetrics("smart-shield")
+						utils.MarkAccessLogShield(r, "smart-shield")
 						utils.Log("SmartShield: Too many users on the server")
 						http.Error(w, "Too many requests", http.StatusTooManyRequests)
 						return
@@ -408,6 +474,7 @@ func SmartShieldMiddleware(shieldID string, route utils.ProxyRouteConfig) func(h
 			if !isPrivileged(r, policy) && !shield.isAllowedToReqest(shieldID, policy, userConsumed) {
 				lastBan := shield.GetLastBan(policy, userConsumed)
 				go metrics.PushShieldMetrics("smart-shield")
+				utils.MarkAccessLogShield(r, "smart-shield")
 				utils.IncrementIPAbuseCounter(clientID)
 
 				utils.TriggerEvent(
@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/madejackson/cosmos-server/src/metrics"
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+const streamDialTimeout = 10 * time.Second
+const udpDefaultSessionTimeout = 60 * time.Second
+
+type streamProxy struct {
+	route  utils.ProxyRouteConfig
+	cancel context.CancelFunc
+	// closed once the listener is released
+	done chan struct{}
+}
+
+var (
+	activeStreams = map[string]*streamProxy{}
+	streamsLock   sync.Mutex
+)
+
+func IsStreamRoute(route utils.ProxyRouteConfig) bool {
+	return route.Mode == "TCP" || route.Mode == "UDP"
+}
+
+func streamKey(route utils.ProxyRouteConfig) string {
+	return strings.ToLower(string(route.Mode)) + "/" + route.ListenPort
+}
+
+// InitStreamProxies starts a listener for every TCP / UDP route, and stops
+// or restarts the ones that were removed or changed since the last call
+func InitStreamProxies() {
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+
+	expected := map[string]utils.ProxyRouteConfig{}
+
+	for _, route := range utils.GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+		if route.Disabled || !IsStreamRoute(route) {
+			continue
+		}
+
+		if route.ListenPort == "" {
+			utils.Error("Stream proxy: route "+route.Name+" has no listen port", nil)
+			continue
+		}
+
+		key := streamKey(route)
+		if other, exists := expected[key]; exists {
+			utils.Error("Stream proxy: route "+route.Name+" uses the same port as "+other.Name, nil)
+			continue
+		}
+
+		expected[key] = route
+	}
+
+	for key, stream := range activeStreams {
+		if route, ok := expected[key]; !ok || !reflect.DeepEqual(route, stream.route) {
+			utils.Log("Stream proxy: stopping " + stream.route.Name + " on " + key)
+			stream.cancel()
+			<-stream.done
+			delete(activeStreams, key)
+		}
+	}
+
+	for key, route := range expected {
+		if _, ok := activeStreams[key]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := &streamProxy{
+			route:  route,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		activeStreams[key] = stream
+
+		if route.Mode == "TCP" {
+			go startTCPStream(ctx, stream)
+		} else {
+			go startUDPStream(ctx, stream)
+		}
+	}
+}
+
+// streamTarget accepts host:port with an optional tcp:// or udp:// prefix
+func streamTarget(route utils.ProxyRouteConfig) string {
+	target := strings.TrimPrefix(strings.TrimPrefix(route.Target, "tcp://"), "udp://")
+
+	// same rule as the Director in NewProxy, resolved on every connection
+	// as the container might have been recreated
+	if os.Getenv("HOSTNAME") == "" || utils.IsHostNetwork {
+		host, port, err := net.SplitHostPort(target)
+		if err == nil {
+			if ip, _ := utils.GetContainerIPByName(host); ip != "" {
+				target = net.JoinHostPort(ip, port)
+			}
+		}
+	}
+
+	return target
+}
+
+func isStreamClientAllowed(route utils.ProxyRouteConfig, addr net.Addr) bool {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	if utils.IsAllowedByRestrictions(ip, route.RestrictToConstellation, route.WhitelistInboundIPs) {
+		return true
+	}
+
+	go metrics.PushShieldMetrics("ip-whitelists")
+
+	utils.TriggerEvent(
+		"cosmos.proxy.shield.whitelist",
+		"Proxy Shield IP blocked by whitelist",
+		"warning",
+		"route@"+route.Name,
+		map[string]interface{}{
+			"clientID": ip,
+			"route":    route.Name,
+		})
+
+	utils.IncrementIPAbuseCounter(ip)
+	utils.Error("Connection from "+ip+" to "+route.Name+" is blocked because of restrictions", nil)
+
+	return false
+}
+
+func startTCPStream(ctx context.Context, stream *streamProxy) {
+	defer close(stream.done)
+
+	route := stream.route
+
+	listener, err := net.Listen("tcp", ":"+route.ListenPort)
+	if err != nil {
+		utils.Error("Stream proxy: failed to listen on TCP "+route.ListenPort+" for "+route.Name, err)
+		return
+	}
+
+	utils.Log("Stream proxy: " + route.Name + " listening on TCP " + route.ListenPort + ", forwarding to " + route.Target)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	conns := sync.WaitGroup{}
+	defer conns.Wait()
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			utils.Error("Stream proxy: failed to accept connection on "+route.Name, err)
+			continue
+		}
+
+		if !isStreamClientAllowed(route, client.RemoteAddr()) {
+			client.Close()
+			continue
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			handleTCPStream(ctx, route, client)
+		}()
+	}
+}
+
+func handleTCPStream(ctx context.Context, route utils.ProxyRouteConfig, client net.Conn) {
+	started := time.Now()
+
+	server, err := net.DialTimeout("tcp", streamTarget(route), streamDialTimeout)
+	if err != nil {
+		utils.Error("Stream proxy: failed to connect to "+route.Target+" for "+route.Name, err)
+		client.Close()
+		go metrics.PushRequestMetrics(route, 502, started, 0)
+		return
+	}
+
+	var bytes int64
+	done := make(chan struct{}, 2)
+
+	go func() {
+		n, _ := io.Copy(server, client)
+		atomic.AddInt64(&bytes, n)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(client, server)
+		atomic.AddInt64(&bytes, n)
+		done <- struct{}{}
+	}()
+
+	finished := 0
+	select {
+	case <-ctx.Done():
+	case <-done:
+		finished++
+	}
+
+	client.Close()
+	server.Close()
+
+	// wait for both copies to report their byte count
+	for ; finished < 2; finished++ {
+		<-done
+	}
+
+	go metrics.PushRequestMetrics(route, 200, started, atomic.LoadInt64(&bytes))
+}
+
+type udpSession struct {
+	client     net.Addr
+	upstream   net.Conn
+	started    time.Time
+	lastActive int64
+	bytes      int64
+	blocked    bool
+}
+
+func startUDPStream(ctx context.Context, stream *streamProxy) {
+	defer close(stream.done)
+
+	route := stream.route
+
+	conn, err := net.ListenPacket("udp", ":"+route.ListenPort)
+	if err != nil {
+		utils.Error("Stream proxy: failed to listen on UDP "+route.ListenPort+" for "+route.Name, err)
+		return
+	}
+
+	utils.Log("Stream proxy: " + route.Name + " listening on UDP " + route.ListenPort + ", forwarding to " + route.Target)
+
+	idleTimeout := route.Timeout
+	if idleTimeout == 0 {
+		idleTimeout = udpDefaultSessionTimeout
+	}
+
+	sessions := map[string]*udpSession{}
+	sessionsLock := sync.Mutex{}
+
+	closeSession := func(key string, session *udpSession) {
+		delete(sessions, key)
+		if !session.blocked {
+			session.upstream.Close()
+			go metrics.PushRequestMetrics(route, 200, session.started, atomic.LoadInt64(&session.bytes))
+		}
+	}
+
+	// UDP has no end of connection, sessions are closed after idleTimeout
+	go func() {
+		tick := idleTimeout / 2
+		if tick < time.Second {
+			tick = time.Second
+		}
+
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+
+				sessionsLock.Lock()
+				for key, session := range sessions {
+					closeSession(key, session)
+				}
+				sessionsLock.Unlock()
+				return
+			case <-ticker.C:
+				sessionsLock.Lock()
+				for key, session := range sessions {
+					if time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive))) > idleTimeout {
+						closeSession(key, session)
+					}
+				}
+				sessionsLock.Unlock()
+			}
+		}
+	}()
+
+	buffer := make([]byte, 65535)
+
+	for {
+		n, clientAddr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			utils.Error("Stream proxy: failed to read UDP packet on "+route.Name, err)
+			continue
+		}
+
+		key := clientAddr.String()
+
+		sessionsLock.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			session = &udpSession{
+				client:     clientAddr,
+				started:    time.Now(),
+				lastActive: time.Now().UnixNano(),
+			}
+
+			if !isStreamClientAllowed(route, clientAddr) {
+				// remembered so the event is not sent for every packet
+				session.blocked = true
+			} else {
+				upstream, err := net.DialTimeout("udp", streamTarget(route), streamDialTimeout)
+				if err != nil {
+					sessionsLock.Unlock()
+					utils.Error("Stream proxy: failed to connect to "+route.Target+" for "+route.Name, err)
+					go metrics.PushRequestMetrics(route, 502, session.started, 0)
+					continue
+				}
+				session.upstream = upstream
+
+				go relayUDPReplies(conn, session)
+			}
+
+			sessions[key] = session
+		}
+		sessionsLock.Unlock()
+
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+
+		if session.blocked {
+			continue
+		}
+
+		if _, err := session.upstream.Write(buffer[:n]); err == nil {
+			atomic.AddInt64(&session.bytes, int64(n))
+		}
+	}
+}
+
+// relayUDPReplies ends when the session is closed
+func relayUDPReplies(conn net.PacketConn, session *udpSession) {
+	buffer := make([]byte, 65535)
+
+	for {
+		n, err := session.upstream.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+
+		if _, err := conn.WriteTo(buffer[:n], session.client); err == nil {
+			atomic.AddInt64(&session.bytes, int64(n))
+		}
+	}
+}
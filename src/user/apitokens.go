@@ -0,0 +1,353 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type CreateAPITokenRequestJSON struct {
+	Name                string   `validate:"required,min=3,max=64"`
+	Scopes              []string `validate:"required,min=1"`
+	ExpiresAt           time.Time
+	WhitelistInboundIPs []string
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateAPIToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return utils.APITokenPrefix + hex.EncodeToString(b), nil
+}
+
+// HasAPIToken only looks at Cosmos tokens, so Bearer tokens meant
+// for other applications are left alone
+func HasAPIToken(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Authorization"), "Bearer "+utils.APITokenPrefix)
+}
+
+func apiTokenAllowsIP(token utils.APIToken, req *http.Request) bool {
+	if len(token.WhitelistInboundIPs) == 0 {
+		return true
+	}
+
+	ip := utils.GetClientIP(req)
+
+	for _, ipRange := range token.WhitelistInboundIPs {
+		if strings.Contains(ipRange, "/") {
+			if ok, _ := utils.IPInRange(ip, ipRange); ok {
+				return true
+			}
+		} else if ip == ipRange {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckAPIToken validates the Bearer token of the request and returns it
+// along with its owner
+func CheckAPIToken(req *http.Request) (utils.APIToken, utils.User, error) {
+	tokenString := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "apitokens")
+	defer closeDb()
+	if errCo != nil {
+		return utils.APIToken{}, utils.User{}, errCo
+	}
+
+	token := utils.APIToken{}
+
+	err := c.FindOne(nil, map[string]interface{}{
+		"Hash": hashAPIToken(tokenString),
+	}).Decode(&token)
+
+	if err != nil {
+		return utils.APIToken{}, utils.User{}, errors.New("API token not found")
+	}
+
+	if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(time.Now()) {
+		return utils.APIToken{}, utils.User{}, errors.New("API token " + token.Name + " is expired")
+	}
+
+	if !apiTokenAllowsIP(token, req) {
+		return utils.APIToken{}, utils.User{}, errors.New("API token " + token.Name + " is not allowed from " + utils.GetClientIP(req))
+	}
+
+	cu, closeDbU, errCoU := utils.GetEmbeddedCollection(utils.GetRootAppId(), "users")
+	defer closeDbU()
+	if errCoU != nil {
+		return utils.APIToken{}, utils.User{}, errCoU
+	}
+
+	owner := utils.User{}
+
+	errU := cu.FindOne(nil, map[string]interface{}{
+		"Nickname": token.Owner,
+	}).Decode(&owner)
+
+	if errU != nil {
+		return utils.APIToken{}, utils.User{}, errors.New("API token " + token.Name + " owner not found")
+	}
+
+	// avoid rewriting the database on every request
+	if token.LastUsed.Add(10 * time.Minute).Before(time.Now()) {
+		c.UpdateOne(nil, map[string]interface{}{
+			"_id": token.ID,
+		}, map[string]interface{}{
+			"$set": map[string]interface{}{
+				"LastUsed": time.Now(),
+			},
+		})
+	}
+
+	owner.MFAState = 0
+
+	return token, owner, nil
+}
+
+// RefreshAPIToken is the API token counterpart of RefreshUserToken
+func RefreshAPIToken(w http.ResponseWriter, req *http.Request) (utils.APIToken, utils.User, error) {
+	token, owner, err := CheckAPIToken(req)
+
+	if err != nil {
+		utils.Error("APIToken: Invalid API token", err)
+		utils.HTTPError(w, "Invalid API token", http.StatusUnauthorized, "HTTP004")
+		return utils.APIToken{}, utils.User{}, err
+	}
+
+	return token, owner, nil
+}
+
+func APITokensRoute(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		ListAPITokens(w, req)
+	} else if req.Method == "POST" {
+		CreateAPIToken(w, req)
+	} else {
+		utils.Error("APITokensRoute: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func APITokenIdRoute(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "DELETE" {
+		DeleteAPIToken(w, req)
+	} else {
+		utils.Error("APITokenIdRoute: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ListAPITokens(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "apitokens")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	tokens := []utils.APIToken{}
+
+	cursor, err := c.Find(nil, map[string]interface{}{})
+	if err != nil {
+		utils.Error("APITokenList: Error while getting tokens", err)
+		utils.HTTPError(w, "API Token Get Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+	defer cursor.Close(nil)
+
+	if err = cursor.All(nil, &tokens); err != nil {
+		utils.Error("APITokenList: Error while decoding tokens", err)
+		utils.HTTPError(w, "API Token Get Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data":   tokens,
+	})
+}
+
+func CreateAPIToken(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	var request CreateAPITokenRequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil {
+		utils.Error("APITokenCreation: Invalid Request", err1)
+		utils.HTTPError(w, "API Token Creation Error", http.StatusBadRequest, "AT002")
+		return
+	}
+
+	errV := utils.Validate.Struct(request)
+	if errV != nil {
+		utils.Error("APITokenCreation: Invalid Request", errV)
+		utils.HTTPError(w, "API Token Creation Error: "+errV.Error(), http.StatusBadRequest, "AT002")
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		if !utils.IsValidAPITokenScope(scope) {
+			utils.Error("APITokenCreation: Invalid scope "+scope, nil)
+			utils.HTTPError(w, "Invalid scope: "+scope, http.StatusBadRequest, "AT003")
+			return
+		}
+	}
+
+	for _, ipRange := range request.WhitelistInboundIPs {
+		if _, _, errC := net.ParseCIDR(ipRange); errC != nil && net.ParseIP(ipRange) == nil {
+			utils.Error("APITokenCreation: Invalid IP "+ipRange, nil)
+			utils.HTTPError(w, "Invalid IP or CIDR: "+ipRange, http.StatusBadRequest, "AT003")
+			return
+		}
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "apitokens")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	name := utils.Sanitize(request.Name)
+
+	existing := utils.APIToken{}
+	errE := c.FindOne(nil, map[string]interface{}{
+		"Name": name,
+	}).Decode(&existing)
+
+	if errE == nil {
+		utils.Error("APITokenCreation: Token already exists", nil)
+		utils.HTTPError(w, "API Token already exists", http.StatusConflict, "AT004")
+		return
+	} else if errE != mongo.ErrNoDocuments {
+		utils.Error("APITokenCreation: Error while finding token", errE)
+		utils.HTTPError(w, "API Token Creation Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+
+	tokenString, errG := generateAPIToken()
+	if errG != nil {
+		utils.Error("APITokenCreation: Error while generating token", errG)
+		utils.HTTPError(w, "API Token Creation Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+
+	token := utils.APIToken{
+		Name:                name,
+		Owner:               req.Header.Get("x-cosmos-user"),
+		Hash:                hashAPIToken(tokenString),
+		Hint:                tokenString[len(tokenString)-4:],
+		Scopes:              request.Scopes,
+		WhitelistInboundIPs: request.WhitelistInboundIPs,
+		ExpiresAt:           request.ExpiresAt,
+		CreatedAt:           time.Now(),
+	}
+
+	_, errI := c.InsertOne(nil, token)
+	if errI != nil {
+		utils.Error("APITokenCreation: Error while creating token", errI)
+		utils.HTTPError(w, "API Token Creation Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+
+	utils.TriggerEvent(
+		"cosmos.user.apitoken.create",
+		"API token created",
+		"important",
+		"",
+		map[string]interface{}{
+			"name":   token.Name,
+			"owner":  token.Owner,
+			"scopes": token.Scopes,
+		})
+
+	// the token is only ever returned here
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"name":  token.Name,
+			"token": tokenString,
+		},
+	})
+}
+
+func DeleteAPIToken(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	vars := mux.Vars(req)
+	id, errId := primitive.ObjectIDFromHex(vars["id"])
+	if errId != nil {
+		utils.Error("APITokenDeletion: Invalid ID", errId)
+		utils.HTTPError(w, "Invalid API token ID", http.StatusBadRequest, "InvalidID")
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "apitokens")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	result, err := c.DeleteOne(nil, map[string]interface{}{
+		"_id": id,
+	})
+
+	if err != nil {
+		utils.Error("APITokenDeletion: Error while deleting token", err)
+		utils.HTTPError(w, "API Token Deletion Error", http.StatusInternalServerError, "AT001")
+		return
+	}
+
+	if result.DeletedCount == 0 {
+		utils.HTTPError(w, "API token not found", http.StatusNotFound, "NotFound")
+		return
+	}
+
+	utils.TriggerEvent(
+		"cosmos.user.apitoken.delete",
+		"API token revoked",
+		"important",
+		"",
+		map[string]interface{}{
+			"id": vars["id"],
+		})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
@@ -0,0 +1,243 @@
+package user
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/madejackson/cosmos-server/src/utils"
+)
+
+type CreateClientCertificateRequestJSON struct {
+	Nickname string `validate:"required,min=3,max=32,alphanum"`
+	Name     string `validate:"required,min=3,max=64"`
+	// 365 when empty
+	ValidityDays int `validate:"omitempty,min=1,max=3650"`
+}
+
+func ClientCertificatesRoute(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		ListClientCertificates(w, req)
+	} else if req.Method == "POST" {
+		CreateClientCertificate(w, req)
+	} else {
+		utils.Error("ClientCertificatesRoute: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ClientCertificateIdRoute(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "DELETE" {
+		RevokeClientCertificate(w, req)
+	} else {
+		utils.Error("ClientCertificateIdRoute: Method not allowed"+req.Method, nil)
+		utils.HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
+
+func ListClientCertificates(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	ca, errCA := utils.GetClientCACertificate()
+	if errCA != nil {
+		utils.Error("ClientCertificateList: Error while loading the client CA", errCA)
+		utils.HTTPError(w, "Client CA Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "clientcertificates")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	certificates := []utils.ClientCertificate{}
+
+	cursor, err := c.Find(nil, map[string]interface{}{})
+	if err != nil {
+		utils.Error("ClientCertificateList: Error while getting certificates", err)
+		utils.HTTPError(w, "Client Certificate Get Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+	defer cursor.Close(nil)
+
+	if err = cursor.All(nil, &certificates); err != nil {
+		utils.Error("ClientCertificateList: Error while decoding certificates", err)
+		utils.HTTPError(w, "Client Certificate Get Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data":   certificates,
+		"ca":     ca,
+	})
+}
+
+func CreateClientCertificate(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	var request CreateClientCertificateRequestJSON
+	err1 := json.NewDecoder(req.Body).Decode(&request)
+	if err1 != nil {
+		utils.Error("ClientCertificateCreation: Invalid Request", err1)
+		utils.HTTPError(w, "Client Certificate Creation Error", http.StatusBadRequest, "CC002")
+		return
+	}
+
+	errV := utils.Validate.Struct(request)
+	if errV != nil {
+		utils.Error("ClientCertificateCreation: Invalid Request", errV)
+		utils.HTTPError(w, "Client Certificate Creation Error: "+errV.Error(), http.StatusBadRequest, "CC002")
+		return
+	}
+
+	nickname := utils.Sanitize(request.Nickname)
+	name := utils.SanitizeSafe(request.Name)
+
+	cu, closeDbU, errCoU := utils.GetEmbeddedCollection(utils.GetRootAppId(), "users")
+	defer closeDbU()
+	if errCoU != nil {
+		utils.Error("Database Connect", errCoU)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	owner := utils.User{}
+	errU := cu.FindOne(nil, map[string]interface{}{
+		"Nickname": nickname,
+	}).Decode(&owner)
+
+	if errU != nil {
+		utils.Error("ClientCertificateCreation: User not found "+nickname, errU)
+		utils.HTTPError(w, "User not found", http.StatusNotFound, "CC003")
+		return
+	}
+
+	validityDays := request.ValidityDays
+	if validityDays == 0 {
+		validityDays = 365
+	}
+
+	certificate, certPEM, keyPEM, errI := utils.IssueClientCertificate(nickname, name, time.Duration(validityDays)*24*time.Hour)
+	if errI != nil {
+		utils.Error("ClientCertificateCreation: Error while issuing certificate", errI)
+		utils.HTTPError(w, "Client Certificate Creation Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+
+	ca, _ := utils.GetClientCACertificate()
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "clientcertificates")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	_, errIn := c.InsertOne(nil, certificate)
+	if errIn != nil {
+		utils.Error("ClientCertificateCreation: Error while saving certificate", errIn)
+		utils.HTTPError(w, "Client Certificate Creation Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+
+	utils.TriggerEvent(
+		"cosmos.user.clientcertificate.create",
+		"Client certificate issued",
+		"important",
+		"",
+		map[string]interface{}{
+			"name":   certificate.Name,
+			"owner":  certificate.Owner,
+			"serial": certificate.Serial,
+		})
+
+	// the key is only ever returned here
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+		"data": map[string]interface{}{
+			"certificate": certificate,
+			"cert":        certPEM,
+			"key":         keyPEM,
+			"ca":          ca,
+		},
+	})
+}
+
+func RevokeClientCertificate(w http.ResponseWriter, req *http.Request) {
+	if utils.AdminOnly(w, req) != nil {
+		return
+	}
+
+	vars := mux.Vars(req)
+	id, errId := primitive.ObjectIDFromHex(vars["id"])
+	if errId != nil {
+		utils.Error("ClientCertificateRevocation: Invalid ID", errId)
+		utils.HTTPError(w, "Invalid client certificate ID", http.StatusBadRequest, "InvalidID")
+		return
+	}
+
+	c, closeDb, errCo := utils.GetEmbeddedCollection(utils.GetRootAppId(), "clientcertificates")
+	defer closeDb()
+	if errCo != nil {
+		utils.Error("Database Connect", errCo)
+		utils.HTTPError(w, "Database", http.StatusInternalServerError, "DB001")
+		return
+	}
+
+	certificate := utils.ClientCertificate{}
+	errF := c.FindOne(nil, map[string]interface{}{
+		"_id": id,
+	}).Decode(&certificate)
+
+	if errF != nil {
+		utils.HTTPError(w, "Client certificate not found", http.StatusNotFound, "NotFound")
+		return
+	}
+
+	// kept in the database, so the revocation outlives the certificate list
+	_, err := c.UpdateOne(nil, map[string]interface{}{
+		"_id": id,
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"Revoked":   true,
+			"RevokedAt": time.Now(),
+		},
+	})
+
+	if err != nil {
+		utils.Error("ClientCertificateRevocation: Error while revoking certificate", err)
+		utils.HTTPError(w, "Client Certificate Revocation Error", http.StatusInternalServerError, "CC001")
+		return
+	}
+
+	utils.MarkClientCertificateRevoked(certificate.Serial)
+
+	utils.TriggerEvent(
+		"cosmos.user.clientcertificate.revoke",
+		"Client certificate revoked",
+		"important",
+		"",
+		map[string]interface{}{
+			"name":   certificate.Name,
+			"owner":  certificate.Owner,
+			"serial": certificate.Serial,
+		})
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "OK",
+	})
+}
@@ -296,4 +296,35 @@ func SendUserToken(w http.ResponseWriter, req *http.Request, user utils.User, mf
 
 	http.SetCookie(w, &cookie)
 	http.SetCookie(w, &clientCookie)
-}
\ No newline at end of file
+}
+// GetTokenUser reads the user from the signed token, without the database checks
+// of RefreshUserToken, for routing decisions only
+func GetTokenUser(req *http.Request) (string, utils.Role, bool) {
+	cookie, err := req.Cookie("jwttoken")
+	if err != nil || cookie.Value == "" {
+		return "", 0, false
+	}
+
+	ed25519Key, errK := jwt.ParseEdPublicKeyFromPEM([]byte(utils.GetPublicAuthKey()))
+	if errK != nil {
+		return "", 0, false
+	}
+
+	claims := jwt.MapClaims{}
+	_, errP := jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		return ed25519Key, nil
+	})
+	if errP != nil {
+		return "", 0, false
+	}
+
+	nickname, ok := claims["nickname"].(string)
+	mfaDone, _ := claims["mfaDone"].(bool)
+	role, _ := claims["role"].(float64)
+
+	if !ok || !mfaDone {
+		return "", 0, false
+	}
+
+	return nickname, utils.Role(role), true
+}
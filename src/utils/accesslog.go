@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natefinch/lumberjack"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	ACCESS_LOG_CLF  = "CLF"
+	ACCESS_LOG_JSON = "JSON"
+)
+
+type AccessLogEntry struct {
+	Date      time.Time `json:"date" bson:"date"`
+	Route     string    `json:"route" bson:"route"`
+	ClientIP  string    `json:"clientIP" bson:"clientIP"`
+	User      string    `json:"user" bson:"user"`
+	Method    string    `json:"method" bson:"method"`
+	Host      string    `json:"host" bson:"host"`
+	URL       string    `json:"url" bson:"url"`
+	Protocol  string    `json:"protocol" bson:"protocol"`
+	Status    int       `json:"status" bson:"status"`
+	Bytes     int64     `json:"bytes" bson:"bytes"`
+	Duration  float64   `json:"duration" bson:"duration"`
+	Shield    string    `json:"shield" bson:"shield"`
+	UserAgent string    `json:"userAgent" bson:"userAgent"`
+	Referer   string    `json:"referer" bson:"referer"`
+}
+
+type accessLogKey struct{}
+
+var accessLog struct {
+	sync.Mutex
+	file *lumberjack.Logger
+}
+
+func AccessLogFile() string {
+	return CONFIGFOLDER + "access.log"
+}
+
+// InitAccessLog (re)opens the access log file with the rotation settings of the config
+func InitAccessLog() {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+
+	if accessLog.file != nil {
+		accessLog.file.Close()
+		accessLog.file = nil
+	}
+
+	config := GetMainConfig().AccessLog
+	if !config.Enabled {
+		return
+	}
+
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = 100
+	}
+
+	maxBackups := config.MaxBackups
+	if maxBackups == 0 {
+		maxBackups = 5
+	}
+
+	accessLog.file = &lumberjack.Logger{
+		Filename:   AccessLogFile(),
+		MaxSize:    maxSize, // megabytes
+		MaxBackups: maxBackups,
+		MaxAge:     config.MaxAge, //days
+		Compress:   true,
+	}
+}
+
+// SetAccessLogRoute names the route serving the request in its access log entry
+func SetAccessLogRoute(r *http.Request, route string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*AccessLogEntry); ok {
+		entry.Route = route
+	}
+}
+
+// MarkAccessLogShield records which shield blocked the request
+func MarkAccessLogShield(r *http.Request, shield string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*AccessLogEntry); ok {
+		entry.Shield = shield
+	}
+}
+
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if w.status == 0 || w.status < 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the Cosmos middlewares set them, not every route goes through the token ones
+		for name := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-cosmos-") {
+				r.Header.Del(name)
+			}
+		}
+
+		config := GetMainConfig().AccessLog
+		if !config.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &AccessLogEntry{
+			Date:      time.Now(),
+			ClientIP:  GetClientIP(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			URL:       r.URL.RequestURI(),
+			Protocol:  r.Proto,
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+		}
+
+		wrapper := &accessLogResponseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(wrapper, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		entry.Status = wrapper.status
+		entry.Bytes = wrapper.bytes
+		entry.Duration = float64(time.Since(entry.Date).Microseconds()) / 1000
+		// set by the authentication middlewares on the shared headers
+		entry.User = r.Header.Get("x-cosmos-user")
+
+		writeAccessLog(entry, config)
+	})
+}
+
+func formatCLF(entry *AccessLogEntry) string {
+	user := entry.User
+	if user == "" {
+		user = "-"
+	}
+
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	return entry.ClientIP + " - " + user + " [" + entry.Date.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+		strconv.Quote(entry.Method+" "+entry.URL+" "+entry.Protocol) + " " + strconv.Itoa(entry.Status) + " " + bytes
+}
+
+func writeAccessLog(entry *AccessLogEntry, config AccessLogConfig) {
+	line := formatCLF(entry)
+	if config.Format == ACCESS_LOG_JSON {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			Error("AccessLog: Error while encoding entry", err)
+		}
+		line = string(data)
+	}
+
+	accessLog.Lock()
+	if accessLog.file != nil && line != "" {
+		if _, err := accessLog.file.Write([]byte(line + "\n")); err != nil {
+			Error("AccessLog: Error while writing to "+AccessLogFile(), err)
+		}
+	}
+	accessLog.Unlock()
+
+	if config.Database {
+		BufferedDBWrite("accesslogs", map[string]interface{}{
+			"date":      entry.Date,
+			"route":     entry.Route,
+			"clientIP":  entry.ClientIP,
+			"user":      entry.User,
+			"method":    entry.Method,
+			"host":      entry.Host,
+			"url":       entry.URL,
+			"protocol":  entry.Protocol,
+			"status":    entry.Status,
+			"bytes":     entry.Bytes,
+			"duration":  entry.Duration,
+			"shield":    entry.Shield,
+			"userAgent": entry.UserAgent,
+			"referer":   entry.Referer,
+		})
+	}
+}
+
+// CleanupAccessLogs removes the entries older than RetentionDays from the database
+func CleanupAccessLogs() {
+	config := GetMainConfig().AccessLog
+	if !config.Database {
+		return
+	}
+
+	retention := config.RetentionDays
+	if retention == 0 {
+		retention = 7
+	}
+
+	c, errCo := GetCollection(GetRootAppId(), "accesslogs")
+	if errCo != nil {
+		Error("AccessLog: Database Connect", errCo)
+		return
+	}
+
+	del, err := c.DeleteMany(context.Background(), bson.M{"date": bson.M{"$lt": time.Now().AddDate(0, 0, -retention)}})
+	if err != nil {
+		Error("AccessLog: Database Cleanup", err)
+		return
+	}
+
+	Log("Cleanup: accesslogs " + strconv.Itoa(int(del.DeletedCount)) + " objects deleted")
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const APITokenPrefix = "cosmos_"
+
+type APIToken struct {
+	ID                  primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name                string             `json:"name" bson:"Name"`
+	Owner               string             `json:"owner" bson:"Owner"`
+	Hash                string             `json:"-" bson:"Hash"`
+	Hint                string             `json:"hint" bson:"Hint"`
+	Scopes              []string           `json:"scopes" bson:"Scopes"`
+	WhitelistInboundIPs []string           `json:"whitelistInboundIPs" bson:"WhitelistInboundIPs"`
+	ExpiresAt           time.Time          `json:"expiresAt" bson:"ExpiresAt"`
+	CreatedAt           time.Time          `json:"createdAt" bson:"CreatedAt"`
+	LastUsed            time.Time          `json:"lastUsed" bson:"LastUsed"`
+}
+
+var APITokenScopes = []string{
+	"servapps:read",
+	"servapps:manage",
+	"config:read",
+	"config:write",
+	"users:read",
+	"users:manage",
+	"metrics:read",
+	"metrics:write",
+	"storage:read",
+	"storage:manage",
+	"constellation:read",
+	"constellation:manage",
+	"jobs:read",
+	"jobs:manage",
+}
+
+type apiTokenScopeRule struct {
+	Path  *regexp.Regexp
+	Read  string
+	Write string
+	// some endpoints change things on GET
+	AlwaysWrite bool
+}
+
+// first match wins, endpoints not listed here cannot be used with an API token
+var apiTokenScopeRules = []apiTokenScopeRule{
+	{regexp.MustCompile(`^/cosmos/api/servapps/[^/]+/(manage|secure|auto-update|terminal|update)(/|$)`), "servapps:read", "servapps:manage", true},
+	{regexp.MustCompile(`^/cosmos/api/images/pull`), "servapps:read", "servapps:manage", true},
+	{regexp.MustCompile(`^/cosmos/api/(servapps|images|volumes?|networks?|docker-service|markets)(/|$)`), "servapps:read", "servapps:manage", false},
+
+	{regexp.MustCompile(`^/cosmos/api/(restart|migrate-host)(/|$)`), "config:read", "config:write", true},
+	// the backup has the environment of every container, secrets included
+	{regexp.MustCompile(`^/cosmos/api/get-backup(/|$)`), "config:read", "config:write", true},
+	{regexp.MustCompile(`^/cosmos/api/(config|smart-shield|certificates|cache)(/|$)`), "config:read", "config:write", false},
+
+	{regexp.MustCompile(`^/cosmos/api/(users|invite|client-certificates)(/|$)`), "users:read", "users:manage", false},
+
+	{regexp.MustCompile(`^/cosmos/api/reset-metrics(/|$)`), "metrics:read", "metrics:write", true},
+	{regexp.MustCompile(`^/cosmos/api/(metrics|list-metrics|events|alerts|access-logs)(/|$)`), "metrics:read", "metrics:write", false},
+
+	{regexp.MustCompile(`^/cosmos/api/snapraid/[^/]+/[^/]+`), "storage:read", "storage:manage", true},
+	{regexp.MustCompile(`^/cosmos/api/(smart-def|disks|mounts?|unmount|merge|snapraid)(/|$)`), "storage:read", "storage:manage", false},
+
+	{regexp.MustCompile(`^/cosmos/api/constellation/(restart|reset|connect|block)(/|$)`), "constellation:read", "constellation:manage", true},
+	{regexp.MustCompile(`^/cosmos/api/constellation(/|$)`), "constellation:read", "constellation:manage", false},
+
+	{regexp.MustCompile(`^/cosmos/api/jobs/(stop|run|delete)(/|$)`), "jobs:read", "jobs:manage", true},
+	{regexp.MustCompile(`^/cosmos/api/jobs(/|$)`), "jobs:read", "jobs:manage", false},
+}
+
+func IsValidAPITokenScope(scope string) bool {
+	return StringArrayContains(APITokenScopes, scope)
+}
+
+// RequiredAPITokenScope returns the scope a token needs to call this endpoint,
+// or an empty string if tokens are not allowed on it
+func RequiredAPITokenScope(req *http.Request) string {
+	for _, rule := range apiTokenScopeRules {
+		if rule.Path.MatchString(req.URL.Path) {
+			if rule.AlwaysWrite || (req.Method != "GET" && req.Method != "HEAD") {
+				return rule.Write
+			}
+			return rule.Read
+		}
+	}
+
+	return ""
+}
+
+func HasAPITokenScope(scopes []string, required string) bool {
+	if StringArrayContains(scopes, required) {
+		return true
+	}
+
+	// write access implies read access
+	if area, level, ok := strings.Cut(required, ":"); ok && level == "read" {
+		for _, scope := range scopes {
+			if strings.HasPrefix(scope, area+":") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CheckAPITokenScope is a no-op for cookie sessions
+func CheckAPITokenScope(w http.ResponseWriter, req *http.Request) error {
+	tokenName := req.Header.Get("x-cosmos-token")
+	if tokenName == "" {
+		return nil
+	}
+
+	scopes := strings.Split(req.Header.Get("x-cosmos-token-scopes"), ",")
+	required := RequiredAPITokenScope(req)
+
+	if required == "" || !HasAPITokenScope(scopes, required) {
+		Error("CheckAPITokenScope: API token "+tokenName+" is missing scope for "+req.Method+" "+req.URL.Path, nil)
+		HTTPError(w, "API token does not have the required scope", http.StatusForbidden, "HTTP008")
+		return errors.New("API token missing scope")
+	}
+
+	return nil
+}
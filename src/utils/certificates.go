@@ -14,6 +14,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"os"
+	"sync"
+	"strings"
+	"net/http"
+	"crypto/tls"
+	"errors"
 	
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
@@ -45,6 +50,12 @@ func GenerateRSAWebCertificates(domains []string) (string, string) {
 		Fatal("Generating Serial Number", err)
 	}
 
+	// certificates of the store are picked by their names
+	dnsNames := domains
+	if len(dnsNames) == 0 {
+		dnsNames = []string{GetMainConfig().HTTPConfig.Hostname}
+	}
+
 	// generate certificate
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
@@ -59,7 +70,7 @@ func GenerateRSAWebCertificates(domains []string) (string, string) {
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 
-		DNSNames: []string{GetMainConfig().HTTPConfig.Hostname},
+		DNSNames: dnsNames,
 
 		// IPAddresses: []net.IP{},
 
@@ -139,10 +150,80 @@ func (u *CertUser) GetPrivateKey() crypto.PrivateKey {
 }
 
 
+// acmeHTTPChallenge answers HTTP-01 challenges through the running HTTP server,
+// for certificates requested after startup when the HTTP port is already taken
+type acmeHTTPChallenge struct {
+	tokens sync.Map
+}
+
+func (p *acmeHTTPChallenge) Present(domain, token, keyAuth string) error {
+	p.tokens.Store(token, keyAuth)
+	return nil
+}
+
+func (p *acmeHTTPChallenge) CleanUp(domain, token, keyAuth string) error {
+	p.tokens.Delete(token)
+	return nil
+}
+
+var ACMEHTTPChallenge = &acmeHTTPChallenge{}
+
+// acmeTLSALPNChallenge answers TLS-ALPN-01 challenges through the running HTTPS server,
+// see certificateStore.GetCertificate
+type acmeTLSALPNChallenge struct {
+	certificates sync.Map
+}
+
+func (p *acmeTLSALPNChallenge) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	p.certificates.Store(strings.ToLower(domain), cert)
+	return nil
+}
+
+func (p *acmeTLSALPNChallenge) CleanUp(domain, token, keyAuth string) error {
+	p.certificates.Delete(strings.ToLower(domain))
+	return nil
+}
+
+func (p *acmeTLSALPNChallenge) get(domain string) *tls.Certificate {
+	if cert, ok := p.certificates.Load(strings.ToLower(domain)); ok {
+		return cert.(*tls.Certificate)
+	}
+	return nil
+}
+
+var ACMETLSALPNChallenge = &acmeTLSALPNChallenge{}
+
+func ACMEChallengeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, http01.ChallengePath("")) {
+			token := strings.TrimPrefix(r.URL.Path, http01.ChallengePath(""))
+			if keyAuth, ok := ACMEHTTPChallenge.tokens.Load(token); ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth.(string)))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func DoLetsEncrypt() (string, string) {
-	config := GetMainConfig()
 	LetsEncryptErrors = []string{}
 
+	return DoLetsEncryptForDomains(GetAllHostnames(true, true), false)
+}
+
+// DoLetsEncryptForDomains requests a certificate for domains only. With useRunningServer,
+// the HTTP-01 challenge goes through ACMEChallengeMiddleware instead of a temporary server
+func DoLetsEncryptForDomains(domains []string, useRunningServer bool) (string, string) {
+	config := GetMainConfig()
+
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		Error("LETSENCRYPT_ECDSA", err)
@@ -157,12 +238,23 @@ func DoLetsEncrypt() (string, string) {
 
 	certConfig := lego.NewConfig(&myUser)
 
-	if os.Getenv("ACME_STAGING") == "true" {
+	if config.HTTPConfig.ACMEDirectoryURL != "" {
+		certConfig.CADirURL = config.HTTPConfig.ACMEDirectoryURL
+	} else if os.Getenv("ACME_STAGING") == "true" {
 		certConfig.CADirURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
 	} else {
 		certConfig.CADirURL = "https://acme-v02.api.letsencrypt.org/directory"
 	}
 
+	if config.HTTPConfig.ACMECABundle != "" {
+		err = trustACMECABundle(certConfig, config.HTTPConfig.ACMECABundle)
+		if err != nil {
+			Error("LETSENCRYPT_CA_BUNDLE", err)
+			LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
+			return "", ""
+		}
+	}
+
 	certConfig.Certificate.KeyType = certcrypto.RSA2048
 
 	client, err := lego.NewClient(certConfig)
@@ -182,23 +274,46 @@ func DoLetsEncrypt() (string, string) {
 
 		err = client.Challenge.SetDNS01Provider(provider)
 	} else {
-		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", config.HTTPConfig.HTTPPort))
-		if err != nil {
-			Error("LETSENCRYPT_HTTP01", err)
-			LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
-			return "", ""
+		challengeType := config.HTTPConfig.ACMEChallenge
+
+		if challengeType != ACMEChallengeList["TLSALPN01"] {
+			if useRunningServer {
+				err = client.Challenge.SetHTTP01Provider(ACMEHTTPChallenge)
+			} else {
+				err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", config.HTTPConfig.HTTPPort))
+			}
+			if err != nil {
+				Error("LETSENCRYPT_HTTP01", err)
+				LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
+				return "", ""
+			}
 		}
 
-		err = client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", config.HTTPConfig.HTTPSPort))
-		if err != nil {
-			Error("LETSENCRYPT_TLS01", err)
-			LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
-			return "", ""
+		if challengeType != ACMEChallengeList["HTTP01"] {
+			if useRunningServer {
+				err = client.Challenge.SetTLSALPN01Provider(ACMETLSALPNChallenge)
+			} else {
+				err = client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", config.HTTPConfig.HTTPSPort))
+			}
+			if err != nil {
+				Error("LETSENCRYPT_TLS01", err)
+				LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
+				return "", ""
+			}
 		}
 	}
 
 	// New users will need to register
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	var reg *registration.Resource
+	if config.HTTPConfig.ACMEEABKeyID != "" {
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  config.HTTPConfig.ACMEEABKeyID,
+			HmacEncoded:          config.HTTPConfig.ACMEEABHMACKey,
+		})
+	} else {
+		reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
 	if err != nil {
 		Error("LETSENCRYPT_REGISTER", err)
 		LetsEncryptErrors = append(LetsEncryptErrors, err.Error())
@@ -206,8 +321,6 @@ func DoLetsEncrypt() (string, string) {
 	}
 	myUser.Registration = reg
 
-	domains := GetAllHostnames(true, true)
-
 	request := certificate.ObtainRequest{
 		Domains: LetsEncryptValidOnly(domains, config.HTTPConfig.DNSChallengeProvider != ""),
 		Bundle:  true,
@@ -223,6 +336,32 @@ func DoLetsEncrypt() (string, string) {
 	return string(certificates.Certificate), string(certificates.PrivateKey)
 }
 
+// trustACMECABundle adds a PEM bundle to the system roots for the requests to the ACME server
+func trustACMECABundle(certConfig *lego.Config, bundle string) error {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM([]byte(bundle)) {
+		return errors.New("no valid certificate found in the ACME CA bundle")
+	}
+
+	transport, ok := certConfig.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("unexpected HTTP transport for the ACME client")
+	}
+
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.RootCAs = pool
+	certConfig.HTTPClient.Transport = transport
+
+	return nil
+}
+
 // You'll need a user or account type that implements acme.User
 type MyUser struct {
 	Email        string
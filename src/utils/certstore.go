@@ -0,0 +1,615 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+const (
+	CERT_SOURCE_ACME       = "acme"
+	CERT_SOURCE_PROVIDED   = "provided"
+	CERT_SOURCE_SELFSIGNED = "selfsigned"
+)
+
+// days before expiry at which a warning is sent
+var certificateExpiryWarnings = []int{30, 14, 7}
+
+type StoredCertificate struct {
+	Domains   []string  `json:"domains"`
+	Source    string    `json:"source"`
+	Main      bool      `json:"main"`
+	Route     string    `json:"route,omitempty"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	KeyType   string    `json:"keyType"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// lowest threshold of certificateExpiryWarnings already sent, kept in the warnings file
+	warned      int
+	certificate *tls.Certificate
+}
+
+func (c *StoredCertificate) DaysLeft() int {
+	return int(time.Until(c.NotAfter).Hours() / 24)
+}
+
+type certificateStore struct {
+	sync.RWMutex
+	// exact hostnames and *.wildcards
+	byHost  map[string]*StoredCertificate
+	all     []*StoredCertificate
+	issuing map[string]bool
+}
+
+// CertStore holds every certificate served over HTTPS, picked by SNI in GetCertificate.
+// Route certificates win over per-domain ones, which win over the main certificate
+var CertStore = &certificateStore{
+	byHost:  map[string]*StoredCertificate{},
+	issuing: map[string]bool{},
+}
+
+func ParseStoredCertificate(certPEM string, keyPEM string, source string) (*StoredCertificate, error) {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	domains := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		domains = append(domains, ip.String())
+	}
+	if len(domains) == 0 && leaf.Subject.CommonName != "" {
+		domains = []string{leaf.Subject.CommonName}
+	}
+
+	issuer := leaf.Issuer.CommonName
+	if issuer == "" && len(leaf.Issuer.Organization) > 0 {
+		issuer = leaf.Issuer.Organization[0]
+	}
+
+	return &StoredCertificate{
+		Domains:     domains,
+		Source:      source,
+		Issuer:      issuer,
+		Serial:      leaf.SerialNumber.Text(16),
+		KeyType:     certificateKeyType(leaf),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		certificate: &cert,
+	}, nil
+}
+
+func certificateKeyType(leaf *x509.Certificate) string {
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA " + strconv.Itoa(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return leaf.PublicKeyAlgorithm.String()
+	}
+}
+
+func isSelfSigned(leaf *x509.Certificate) bool {
+	return leaf.CheckSignatureFrom(leaf) == nil
+}
+
+func normalizeCertHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Split(host, ":")[0], "."))
+}
+
+func (s *certificateStore) add(stored *StoredCertificate, extraHosts ...string) {
+	s.all = append(s.all, stored)
+
+	for _, host := range append(stored.Domains, extraHosts...) {
+		s.byHost[normalizeCertHost(host)] = stored
+	}
+
+	// drop the certificates that got fully replaced, the main one stays as the fallback
+	used := map[*StoredCertificate]bool{}
+	for _, c := range s.byHost {
+		used[c] = true
+	}
+
+	all := s.all[:0]
+	for _, c := range s.all {
+		if used[c] || c.Main {
+			all = append(all, c)
+		}
+	}
+	s.all = all
+}
+
+func (s *certificateStore) lookup(serverName string) *StoredCertificate {
+	name := normalizeCertHost(serverName)
+
+	if stored, ok := s.byHost[name]; ok {
+		return stored
+	}
+
+	if dot := strings.Index(name, "."); dot > 0 {
+		if stored, ok := s.byHost["*"+name[dot:]]; ok {
+			return stored
+		}
+	}
+
+	return nil
+}
+
+// GetCertificate is meant for tls.Config, returning nil lets crypto/tls
+// fall back to tls.Config.Certificates
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// TLS-ALPN-01 validation from the ACME server
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == tlsalpn01.ACMETLS1Protocol {
+		if cert := ACMETLSALPNChallenge.get(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		return nil, errors.New("no pending TLS-ALPN-01 challenge for " + hello.ServerName)
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if stored := s.lookup(hello.ServerName); stored != nil {
+		return stored.certificate, nil
+	}
+
+	return nil, nil
+}
+
+func (s *certificateStore) Covers(hostname string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	stored := s.lookup(hostname)
+	return stored != nil && stored.NotAfter.After(time.Now())
+}
+
+func (s *certificateStore) List() []StoredCertificate {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]StoredCertificate, 0, len(s.all))
+	for _, stored := range s.all {
+		list = append(list, *stored)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NotAfter.Before(list[j].NotAfter)
+	})
+
+	return list
+}
+
+func domainCertificatesFolder(source string) string {
+	return CONFIGFOLDER + "certificates/" + source + "/"
+}
+
+func domainCertificateFile(domain string) string {
+	return strings.Replace(normalizeCertHost(domain), "*", "_wildcard", 1)
+}
+
+func certificateWarningsFile() string {
+	return CONFIGFOLDER + "certificates/warnings.json"
+}
+
+// loadCertificateWarnings returns the lowest threshold already warned per serial
+func loadCertificateWarnings() map[string]int {
+	warned := map[string]int{}
+
+	data, err := os.ReadFile(certificateWarningsFile())
+	if os.IsNotExist(err) {
+		return warned
+	} else if err != nil {
+		Error("Certificates: cannot read the expiry warnings", err)
+		return warned
+	}
+
+	if err := json.Unmarshal(data, &warned); err != nil {
+		Error("Certificates: invalid expiry warnings file", err)
+	}
+
+	return warned
+}
+
+func saveCertificateWarnings(warned map[string]int) error {
+	if err := os.MkdirAll(CONFIGFOLDER+"certificates/", 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(warned)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(certificateWarningsFile(), data, 0600)
+}
+
+func SaveDomainCertificate(domain string, source string, certPEM string, keyPEM string) error {
+	folder := domainCertificatesFolder(source)
+
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(folder+domainCertificateFile(domain)+".crt", []byte(certPEM), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(folder+domainCertificateFile(domain)+".key", []byte(keyPEM), 0600)
+}
+
+func loadDomainCertificates(s *certificateStore, source string) {
+	files, _ := filepath.Glob(domainCertificatesFolder(source) + "*.crt")
+
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+
+		certPEM, errC := os.ReadFile(certFile)
+		keyPEM, errK := os.ReadFile(keyFile)
+		if errC != nil || errK != nil {
+			Error("Certificates: cannot read "+certFile, errors.Join(errC, errK))
+			continue
+		}
+
+		stored, err := ParseStoredCertificate(string(certPEM), string(keyPEM), source)
+		if err != nil {
+			Error("Certificates: invalid certificate "+certFile, err)
+			continue
+		}
+
+		if stored.NotAfter.Before(time.Now()) {
+			Warn("Certificates: " + certFile + " is expired, it will be replaced")
+			continue
+		}
+
+		s.add(stored)
+	}
+}
+
+// ReloadCertificateStore rebuilds the store from the main certificate,
+// the per-domain certificates on disk and the certificates of the routes
+func ReloadCertificateStore(mainCert string, mainKey string) {
+	store := &certificateStore{
+		byHost: map[string]*StoredCertificate{},
+	}
+
+	if mainCert != "" && mainKey != "" {
+		source := CERT_SOURCE_PROVIDED
+		if GetMainConfig().HTTPConfig.HTTPSCertificateMode == HTTPSCertModeList["LETSENCRYPT"] {
+			source = CERT_SOURCE_ACME
+		}
+
+		stored, err := ParseStoredCertificate(mainCert, mainKey, source)
+		if err != nil {
+			Error("Certificates: invalid main certificate", err)
+		} else {
+			// also covers the fallback from Let's Encrypt to self-signed
+			if isSelfSigned(stored.certificate.Leaf) {
+				stored.Source = CERT_SOURCE_SELFSIGNED
+			}
+			stored.Main = true
+			store.add(stored)
+		}
+	}
+
+	loadDomainCertificates(store, CERT_SOURCE_SELFSIGNED)
+	loadDomainCertificates(store, CERT_SOURCE_ACME)
+
+	for _, route := range GetMainConfig().HTTPConfig.ProxyConfig.Routes {
+		if route.Disabled || route.TLSCert == "" || route.TLSKey == "" {
+			continue
+		}
+
+		stored, err := ParseStoredCertificate(route.TLSCert, route.TLSKey, CERT_SOURCE_PROVIDED)
+		if err != nil {
+			Error("Certificates: invalid certificate for route "+route.Name, err)
+			continue
+		}
+		stored.Route = route.Name
+
+		if route.UseHost && route.Host != "" {
+			store.add(stored, route.Host)
+		} else {
+			store.add(stored)
+		}
+	}
+
+	warned := loadCertificateWarnings()
+
+	CertStore.Lock()
+	// keep track of the warnings already sent for the certificates still in use, also across restarts
+	for _, stored := range store.all {
+		stored.warned = warned[stored.Serial]
+		for _, previous := range CertStore.all {
+			if previous.Serial == stored.Serial && previous.warned != 0 {
+				stored.warned = previous.warned
+			}
+		}
+	}
+	CertStore.byHost = store.byHost
+	CertStore.all = store.all
+	CertStore.Unlock()
+
+	Log("Certificates: " + strconv.Itoa(len(store.all)) + " certificate(s) loaded")
+}
+
+func MissingCertificateDomains(domains []string) []string {
+	missing := []string{}
+
+	for _, domain := range domains {
+		if !CertStore.Covers(domain) {
+			missing = append(missing, domain)
+		}
+	}
+
+	return missing
+}
+
+// IssueDomainCertificates gets a certificate for each domain on its own, so adding
+// a route does not require the main certificate to be reissued
+func IssueDomainCertificates(domains []string, mode string) {
+	if mode != HTTPSCertModeList["LETSENCRYPT"] && mode != HTTPSCertModeList["SELFSIGNED"] {
+		return
+	}
+
+	for _, domain := range domains {
+		CertStore.Lock()
+		if CertStore.issuing[domain] {
+			CertStore.Unlock()
+			continue
+		}
+		CertStore.issuing[domain] = true
+		CertStore.Unlock()
+
+		if !issueDomainCertificate(domain, mode) {
+			TriggerEvent(
+				"cosmos.proxy.certificate.error",
+				"Certificate renewal failed for "+domain,
+				"error",
+				"",
+				map[string]interface{}{
+					"domain": domain,
+				})
+
+			WriteNotification(Notification{
+				Recipient: "admin",
+				Title:     "Certificate Renewal Failed",
+				Message:   "Cosmos could not get a TLS certificate for " + domain + ". Check the logs for more details.",
+				Level:     "error",
+			})
+		}
+
+		CertStore.Lock()
+		delete(CertStore.issuing, domain)
+		CertStore.Unlock()
+	}
+}
+
+func issueDomainCertificate(domain string, mode string) bool {
+	var pub, priv, source string
+
+	if mode == HTTPSCertModeList["LETSENCRYPT"] {
+		valid := LetsEncryptValidOnly([]string{domain}, GetMainConfig().HTTPConfig.DNSChallengeProvider != "")
+		if len(valid) == 0 {
+			Error("Certificates: "+domain+" cannot get a Let's Encrypt certificate", nil)
+			return false
+		}
+
+		Log("Certificates: requesting a Let's Encrypt certificate for " + domain)
+		pub, priv = DoLetsEncryptForDomains(valid, true)
+		source = CERT_SOURCE_ACME
+	} else {
+		Log("Certificates: generating a self-signed certificate for " + domain)
+		pub, priv = GenerateRSAWebCertificates([]string{domain})
+		source = CERT_SOURCE_SELFSIGNED
+	}
+
+	if pub == "" || priv == "" {
+		Error("Certificates: could not get a certificate for "+domain, nil)
+		return false
+	}
+
+	stored, err := ParseStoredCertificate(pub, priv, source)
+	if err != nil {
+		Error("Certificates: invalid certificate issued for "+domain, err)
+		return false
+	}
+
+	if err := SaveDomainCertificate(domain, source, pub, priv); err != nil {
+		Error("Certificates: could not save certificate for "+domain, err)
+	}
+
+	CertStore.Lock()
+	// keep route certificates on top
+	if existing := CertStore.lookup(domain); existing == nil || existing.Route == "" {
+		CertStore.add(stored)
+	}
+	CertStore.Unlock()
+
+	TriggerEvent(
+		"cosmos.proxy.certificate",
+		"Certificate issued for "+domain,
+		"important",
+		"",
+		map[string]interface{}{
+			"domains": stored.Domains,
+			"source":  source,
+		})
+
+	return true
+}
+
+// CheckCertificatesExpiry warns about certificates expiring in 30, 14 and 7 days
+// and renews the per-domain ones, the main certificate is renewed by checkCerts
+func CheckCertificatesExpiry() {
+	mode := GetMainConfig().HTTPConfig.HTTPSCertificateMode
+	renew := []string{}
+	expiring := []StoredCertificate{}
+	warned := map[string]int{}
+
+	CertStore.Lock()
+	for _, stored := range CertStore.all {
+		days := stored.DaysLeft()
+
+		threshold := 0
+		for _, warning := range certificateExpiryWarnings {
+			if days <= warning {
+				threshold = warning
+			}
+		}
+
+		if threshold != 0 && (stored.warned == 0 || threshold < stored.warned) {
+			stored.warned = threshold
+			expiring = append(expiring, *stored)
+		}
+
+		if stored.warned != 0 {
+			warned[stored.Serial] = stored.warned
+		}
+
+		if !stored.Main && stored.Route == "" && days <= certificateExpiryWarnings[0] && len(stored.Domains) > 0 {
+			renew = append(renew, stored.Domains[0])
+		}
+	}
+	CertStore.Unlock()
+
+	// the certificates no longer in use are dropped from the file
+	if len(expiring) > 0 {
+		if err := saveCertificateWarnings(warned); err != nil {
+			Error("Certificates: cannot save the expiry warnings", err)
+		}
+	}
+
+	for _, stored := range expiring {
+		days := stored.DaysLeft()
+		domains := strings.Join(stored.Domains, ", ")
+
+		message := "The TLS certificate for " + domains + " expires in " + strconv.Itoa(days) + " days (" + stored.NotAfter.Format("2006-01-02") + ")"
+		if days < 0 {
+			message = "The TLS certificate for " + domains + " expired on " + stored.NotAfter.Format("2006-01-02")
+		}
+
+		Warn("Certificates: " + message)
+
+		TriggerEvent(
+			"cosmos.proxy.certificate.expiring",
+			"Certificate for "+domains+" expires in "+strconv.Itoa(days)+" days",
+			"warning",
+			"",
+			map[string]interface{}{
+				"domains":  stored.Domains,
+				"source":   stored.Source,
+				"route":    stored.Route,
+				"notAfter": stored.NotAfter,
+			})
+
+		WriteNotification(Notification{
+			Recipient: "admin",
+			Title:     "Certificate Expiring Soon",
+			Message:   message,
+			Level:     "warning",
+		})
+	}
+
+	if len(renew) > 0 {
+		Log("Certificates: renewing " + strings.Join(renew, ", "))
+		IssueDomainCertificates(renew, mode)
+	}
+}
+
+// RenewDomainCertificate issues a new certificate for this domain only, it takes
+// over from the main certificate for this domain
+func RenewDomainCertificate(domain string) error {
+	mode := GetMainConfig().HTTPConfig.HTTPSCertificateMode
+	if mode != HTTPSCertModeList["LETSENCRYPT"] && mode != HTTPSCertModeList["SELFSIGNED"] {
+		return errors.New("certificates are not managed by Cosmos in this HTTPS mode")
+	}
+
+	domain = normalizeCertHost(domain)
+	if !StringArrayContains(GetAllHostnames(false, true), domain) {
+		return errors.New("unknown domain " + domain)
+	}
+
+	CertStore.RLock()
+	existing := CertStore.lookup(domain)
+	CertStore.RUnlock()
+
+	if existing != nil && existing.Route != "" {
+		return errors.New("the certificate of " + domain + " is provided by route " + existing.Route)
+	}
+
+	go IssueDomainCertificates([]string{domain}, mode)
+
+	return nil
+}
+
+type RenewCertificateRequestJSON struct {
+	Domain string `validate:"required"`
+}
+
+func CertificatesRoute(w http.ResponseWriter, req *http.Request) {
+	if AdminOnly(w, req) != nil {
+		return
+	}
+
+	if req.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "OK",
+			"data":   CertStore.List(),
+		})
+	} else if req.Method == "POST" {
+		var request RenewCertificateRequestJSON
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			Error("CertificateRenew: Invalid Request", err)
+			HTTPError(w, "Invalid Request", http.StatusBadRequest, "CR001")
+			return
+		}
+
+		errV := Validate.Struct(request)
+		if errV != nil {
+			Error("CertificateRenew: Invalid Request", errV)
+			HTTPError(w, "Invalid Request: "+errV.Error(), http.StatusBadRequest, "CR001")
+			return
+		}
+
+		if err := RenewDomainCertificate(request.Domain); err != nil {
+			Error("CertificateRenew: "+request.Domain, err)
+			HTTPError(w, "Cannot renew certificate: "+err.Error(), http.StatusBadRequest, "CR002")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "OK",
+			"message": "Renewal started for " + request.Domain,
+		})
+	} else {
+		Error("CertificatesRoute: Method not allowed"+req.Method, nil)
+		HTTPError(w, "Method not allowed", http.StatusMethodNotAllowed, "HTTP001")
+		return
+	}
+}
@@ -0,0 +1,362 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ClientCertificate struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"Name"`
+	Owner     string             `json:"owner" bson:"Owner"`
+	Serial    string             `json:"serial" bson:"Serial"`
+	Subject   string             `json:"subject" bson:"Subject"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"ExpiresAt"`
+	CreatedAt time.Time          `json:"createdAt" bson:"CreatedAt"`
+	Revoked   bool               `json:"revoked" bson:"Revoked"`
+	RevokedAt time.Time          `json:"revokedAt" bson:"RevokedAt"`
+}
+
+type clientCA struct {
+	sync.Mutex
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	// serials of the revoked certificates, loaded on first use
+	revoked map[string]bool
+}
+
+var internalClientCA = &clientCA{}
+
+func clientCAFiles() (string, string) {
+	return CONFIGFOLDER + "certificates/client-ca.crt", CONFIGFOLDER + "certificates/client-ca.key"
+}
+
+func (ca *clientCA) load() error {
+	if ca.cert != nil {
+		return nil
+	}
+
+	certFile, keyFile := clientCAFiles()
+
+	certPEM, errC := os.ReadFile(certFile)
+	keyPEM, errK := os.ReadFile(keyFile)
+
+	if errors.Is(errC, os.ErrNotExist) && errors.Is(errK, os.ErrNotExist) {
+		return ca.generate()
+	} else if errC != nil || errK != nil {
+		return errors.Join(errC, errK)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("unexpected key type for the client CA")
+	}
+
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = string(certPEM)
+
+	return nil
+}
+
+func (ca *clientCA) generate() error {
+	Log("Generating the internal client certificate authority")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Cosmos Personal Server"},
+			CommonName:   "Cosmos Client CA",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+
+	certFile, keyFile := clientCAFiles()
+
+	if err := os.MkdirAll(CONFIGFOLDER+"certificates", 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, []byte(certPEM), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, []byte(keyPEM), 0600); err != nil {
+		return err
+	}
+
+	ca.cert = cert
+	ca.key = key
+	ca.certPEM = certPEM
+
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GetClientCACertificate returns the PEM of the internal CA, created on first use
+func GetClientCACertificate() (string, error) {
+	internalClientCA.Lock()
+	defer internalClientCA.Unlock()
+
+	if err := internalClientCA.load(); err != nil {
+		return "", err
+	}
+
+	return internalClientCA.certPEM, nil
+}
+
+// IssueClientCertificate signs a new client certificate with the internal CA,
+// the key is not kept by Cosmos
+func IssueClientCertificate(owner string, name string, validity time.Duration) (ClientCertificate, string, string, error) {
+	internalClientCA.Lock()
+	defer internalClientCA.Unlock()
+
+	if err := internalClientCA.load(); err != nil {
+		return ClientCertificate{}, "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return ClientCertificate{}, "", "", err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return ClientCertificate{}, "", "", err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(internalClientCA.cert.NotAfter) {
+		notAfter = internalClientCA.cert.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"Cosmos Personal Server"},
+			OrganizationalUnit: []string{name},
+			CommonName:         owner,
+		},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, internalClientCA.cert, &key.PublicKey, internalClientCA.key)
+	if err != nil {
+		return ClientCertificate{}, "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return ClientCertificate{}, "", "", err
+	}
+
+	info := ClientCertificate{
+		Name:      name,
+		Owner:     owner,
+		Serial:    serial.Text(16),
+		Subject:   template.Subject.String(),
+		ExpiresAt: notAfter,
+		CreatedAt: now,
+	}
+
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+
+	return info, certPEM, keyPEM, nil
+}
+
+func (ca *clientCA) isRevoked(serial string) bool {
+	ca.Lock()
+	defer ca.Unlock()
+
+	if ca.revoked == nil {
+		c, closeDb, errCo := GetEmbeddedCollection(GetRootAppId(), "clientcertificates")
+		defer closeDb()
+		if errCo != nil {
+			Error("ClientCertificates: Database Connect", errCo)
+			// refuse everything until the revocation list can be read
+			return true
+		}
+
+		certificates := []ClientCertificate{}
+
+		cursor, err := c.Find(nil, map[string]interface{}{
+			"Revoked": true,
+		})
+		if err != nil {
+			Error("ClientCertificates: Error while loading revoked certificates", err)
+			return true
+		}
+		defer cursor.Close(nil)
+
+		if err = cursor.All(nil, &certificates); err != nil {
+			Error("ClientCertificates: Error while decoding revoked certificates", err)
+			return true
+		}
+
+		ca.revoked = map[string]bool{}
+		for _, certificate := range certificates {
+			ca.revoked[certificate.Serial] = true
+		}
+	}
+
+	return ca.revoked[serial]
+}
+
+// MarkClientCertificateRevoked takes effect on the next request, without restart
+func MarkClientCertificateRevoked(serial string) {
+	internalClientCA.Lock()
+	defer internalClientCA.Unlock()
+
+	if internalClientCA.revoked != nil {
+		internalClientCA.revoked[serial] = true
+	}
+}
+
+// ClientCertificatePool returns the CAs accepted by a route, the internal CA when caPEM is empty
+func ClientCertificatePool(caPEM string) (*x509.CertPool, bool, error) {
+	pool := x509.NewCertPool()
+
+	if caPEM == "" {
+		internalClientCA.Lock()
+		defer internalClientCA.Unlock()
+
+		if err := internalClientCA.load(); err != nil {
+			return nil, true, err
+		}
+
+		pool.AddCert(internalClientCA.cert)
+		return pool, true, nil
+	}
+
+	if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, false, errors.New("no valid certificate found in the client CA")
+	}
+
+	return pool, false, nil
+}
+
+// VerifyClientCertificate checks the certificate sent during the TLS handshake against pool
+func VerifyClientCertificate(state *tls.ConnectionState, pool *x509.CertPool, internal bool) (*x509.Certificate, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := state.PeerCertificates[0]
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if internal && internalClientCA.isRevoked(leaf.SerialNumber.Text(16)) {
+		return nil, errors.New("client certificate " + leaf.SerialNumber.Text(16) + " is revoked")
+	}
+
+	return leaf, nil
+}
+
+func clientCertificateHosts() map[string]bool {
+	hosts := map[string]bool{}
+
+	config := GetMainConfig()
+	for _, route := range config.HTTPConfig.ProxyConfig.Routes {
+		if route.Disabled || !route.ClientCertAuth.Enabled {
+			continue
+		}
+
+		if route.UseHost && route.Host != "" {
+			hosts[normalizeCertHost(route.Host)] = true
+		} else {
+			hosts[normalizeCertHost(config.HTTPConfig.Hostname)] = true
+		}
+	}
+
+	return hosts
+}
+
+// ClientCertificateTLSConfig asks for a client certificate only on the hostnames
+// of routes with ClientCertAuth, so browsers do not prompt for one everywhere
+func ClientCertificateTLSConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !clientCertificateHosts()[strings.ToLower(hello.ServerName)] {
+			return nil, nil
+		}
+
+		config := base.Clone()
+		// verified per route by the proxy, as each route can trust a different CA
+		config.ClientAuth = tls.RequestClientCert
+		return config, nil
+	}
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// https://www.cloudflare.com/ips/
+var trustedProxyPresets = map[string][]string{
+	"cloudflare": {
+		"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18",
+		"108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17",
+		"162.158.0.0/15", "104.16.0.0/13", "104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+		"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32", "2405:8100::/32",
+		"2a06:98c0::/29", "2c0f:f248::/32",
+	},
+	"private": {
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+	},
+	"loopback": {
+		"127.0.0.0/8", "::1/128",
+	},
+}
+
+var trustedProxies struct {
+	sync.RWMutex
+	networks []*net.IPNet
+	enabled  bool
+}
+
+type clientIPKey struct{}
+
+// ParseTrustedProxies accepts CIDRs, IPs and the names of the presets
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		cidrs := []string{entry}
+		if preset, ok := trustedProxyPresets[strings.ToLower(entry)]; ok {
+			cidrs = preset
+		}
+
+		for _, cidr := range cidrs {
+			if !strings.Contains(cidr, "/") {
+				if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+	}
+
+	return networks, nil
+}
+
+// InitTrustedProxies loads TrustedProxies from the config, only loopback is trusted
+// when it is empty but UseForwardedFor or ProxyProtocol is on: behind the docker bridge
+// every client comes from a private IP and could spoof X-Forwarded-For
+func InitTrustedProxies() {
+	config := GetMainConfig().HTTPConfig
+
+	list := config.TrustedProxies
+	enabled := config.UseForwardedFor || config.ProxyProtocol || len(list) > 0
+	if enabled && len(list) == 0 {
+		Warn("TrustedProxies: empty, only loopback proxies are trusted, add the IPs of your proxies to TrustedProxies")
+		list = []string{"loopback"}
+	}
+
+	networks, err := ParseTrustedProxies(list)
+	if err != nil {
+		Error("TrustedProxies: invalid entry, no proxy will be trusted", err)
+		networks = []*net.IPNet{}
+	}
+
+	trustedProxies.Lock()
+	defer trustedProxies.Unlock()
+
+	trustedProxies.networks = networks
+	trustedProxies.enabled = enabled
+}
+
+func IsTrustedProxy(ip net.IP) bool {
+	trustedProxies.RLock()
+	defer trustedProxies.RUnlock()
+
+	if !trustedProxies.enabled || ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// IsTrustedForwarder tells if the direct peer of the request is a trusted proxy
+func IsTrustedForwarder(req *http.Request) bool {
+	return IsTrustedProxy(net.ParseIP(remoteIP(req.RemoteAddr)))
+}
+
+func parseForwardedHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	// some proxies add the port
+	return net.ParseIP(remoteIP(hop))
+}
+
+// resolveClientIP reads X-Forwarded-For from right to left, skipping the trusted
+// proxies, so the first untrusted hop is the client and the rest cannot be spoofed
+func resolveClientIP(req *http.Request) string {
+	ip := remoteIP(req.RemoteAddr)
+
+	if !IsTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+
+	hops := []string{}
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedHop(hops[i])
+		if hop == nil {
+			break
+		}
+
+		ip = hop.String()
+		if !IsTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// GetClientIP returns the IP of the client, without port, behind the trusted proxies
+func GetClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return resolveClientIP(req)
+}
+
+// ClientIPMiddleware resolves the client IP once, for every middleware after it
+func ClientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// ClientIPRateLimitKey is the httprate key function using the resolved client IP
+func ClientIPRateLimitKey(r *http.Request) (string, error) {
+	return GetClientIP(r), nil
+}
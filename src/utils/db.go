@@ -373,4 +373,36 @@ func initDB() {
 			return // Handle error appropriately
 		}
 	}
+
+	c, errCo = GetCollection(GetRootAppId(), "accesslogs")
+	if errCo != nil {
+		Error("Metrics - Database Connect", errCo)
+	} else {
+		// access logs are filtered by date
+		model := mongo.IndexModel{
+			Keys: bson.M{"date": -1},
+		}
+
+		_, err := c.Indexes().CreateOne(context.Background(), model)
+		if err != nil {
+			Error("Metrics - Create Index", err)
+			return // Handle error appropriately
+		}
+	}
+
+	c, errCo = GetCollection(GetRootAppId(), "dnslogs")
+	if errCo != nil {
+		Error("Metrics - Database Connect", errCo)
+	} else {
+		// so are the DNS queries
+		model := mongo.IndexModel{
+			Keys: bson.M{"date": -1},
+		}
+
+		_, err := c.Indexes().CreateOne(context.Background(), model)
+		if err != nil {
+			Error("Metrics - Create Index", err)
+			return // Handle error appropriately
+		}
+	}
 }
@@ -71,6 +71,10 @@ func LoggedInWeakOnly(w http.ResponseWriter, req *http.Request) error {
 		return errors.New("User not logged in")
 	}
 
+	if errS := CheckAPITokenScope(w, req); errS != nil {
+		return errS
+	}
+
 	return nil
 }
 
@@ -106,6 +110,10 @@ func LoggedInOnly(w http.ResponseWriter, req *http.Request) error {
 		return errors.New("User requires MFA Setup")
 	}
 
+	if errS := CheckAPITokenScope(w, req); errS != nil {
+		return errS
+	}
+
 	return nil
 }
 
@@ -137,6 +145,10 @@ func AdminOnly(w http.ResponseWriter, req *http.Request) error {
 		return errors.New("User requires MFA Setup")
 	}
 
+	if errS := CheckAPITokenScope(w, req); errS != nil {
+		return errS
+	}
+
 	return nil
 }
 
@@ -172,5 +184,9 @@ func AdminOrItselfOnly(w http.ResponseWriter, req *http.Request, nickname string
 		return errors.New("User requires MFA Setup")
 	}
 
+	if errS := CheckAPITokenScope(w, req); errS != nil {
+		return errS
+	}
+
 	return nil
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"context"
 	"net/http"
 	"time"
@@ -50,8 +51,8 @@ func getIPAbuseCounter(ip string) int64 {
 
 func BlockBannedIPs(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        ip, _, err := net.SplitHostPort(r.RemoteAddr)
-        if err != nil {
+        ip := GetClientIP(r)
+        if ip == "" {
 					if hj, ok := w.(http.Hijacker); ok {
 							conn, _, err := hj.Hijack()
 							if err == nil {
@@ -68,6 +69,7 @@ func BlockBannedIPs(next http.Handler) http.Handler {
 				}
 
         if nbAbuse > 300 {
+					MarkAccessLogShield(r, "banned-ip")
 					if hj, ok := w.(http.Hijacker); ok {
 							conn, _, err := hj.Hijack()
 							if err == nil {
@@ -88,6 +90,10 @@ func CleanBannedIPs() {
 	})
 }
 
+func ResetIPAbuseCounter(ip string) {
+	BannedIPs.Delete(ip)
+}
+
 func MiddlewareTimeout(timeout time.Duration) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
@@ -120,6 +126,25 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// the limit applies to the bytes on the wire, so compressed streams flush through it
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func BandwithLimiterMiddleware(max int64) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -204,8 +229,8 @@ func GetIPLocation(ip string) (string, error) {
 func BlockByCountryMiddleware(blockedCountries []string, CountryBlacklistIsWhitelist bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
+			ip := GetClientIP(r)
+			if ip == "" {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
 				return
 			}
@@ -227,6 +252,7 @@ func BlockByCountryMiddleware(blockedCountries []string, CountryBlacklistIsWhite
 
 						if blocked {
 							PushShieldMetrics("geo")
+							MarkAccessLogShield(r, "geo")
 							IncrementIPAbuseCounter(ip)
 
 							TriggerEvent(
@@ -270,10 +296,11 @@ func BlockPostWithoutReferer(next http.Handler) http.Handler {
 			referer := r.Header.Get("Referer")
 			if referer == "" {
 				PushShieldMetrics("referer")
+				MarkAccessLogShield(r, "referer")
 				Error("Blocked POST request without Referer header", nil)
 				http.Error(w, "Bad Request: Invalid request.", http.StatusBadRequest)
 
-				ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+				ip := GetClientIP(r)
 				if ip != "" {
 					TriggerEvent(
 						"cosmos.proxy.shield.referer",
@@ -328,11 +355,12 @@ func EnsureHostname(next http.Handler) http.Handler {
 		
 		if !isOk {
 			PushShieldMetrics("hostname")
+			MarkAccessLogShield(r, "hostname")
 			Error("Invalid Hostname " + r.Host + " for request. Expecting one of " + fmt.Sprintf("%v", hostnames), nil)
 			w.WriteHeader(http.StatusBadRequest)
 			http.Error(w, "Bad Request: Invalid hostname. Use your domain instead of your IP to access your server. Check logs if more details are needed.", http.StatusBadRequest)
 			
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := GetClientIP(r)
 			if ip != "" {
 				TriggerEvent(
 					"cosmos.proxy.shield.hostname",
@@ -361,6 +389,10 @@ func AdminOnlyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if CheckAPITokenScope(w, r) != nil {
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -391,11 +423,12 @@ func EnsureHostnameCosmosAPI(next http.Handler) http.Handler {
 
 		if og != reqHostNoPort {
 			PushShieldMetrics("hostname")
+			MarkAccessLogShield(r, "hostname")
 			Error("Invalid Hostname " + r.Host + " for request", nil)
 			w.WriteHeader(http.StatusBadRequest)
 			http.Error(w, "Bad Request: Invalid hostname. Use your domain instead of your IP to access your server. Check logs if more details are needed.", http.StatusBadRequest)
 			
-			ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+			ip := GetClientIP(r)
 			if ip != "" {
 				TriggerEvent(
 					"cosmos.proxy.shield.hostname",
@@ -462,76 +495,47 @@ func IPInRange(ipStr, cidrStr string) (bool, error) {
 	return cidrNet.Contains(ip), nil
 }
 
-func Restrictions(RestrictToConstellation bool, WhitelistInboundIPs []string) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-
-		isUsingWhiteList := len(WhitelistInboundIPs) > 0
+// IsAllowedByRestrictions tells if ip can go through a RestrictToConstellation / WhitelistInboundIPs pair,
+// when both are set being in either is enough
+func IsAllowedByRestrictions(ip string, RestrictToConstellation bool, WhitelistInboundIPs []string) bool {
+	isUsingWhiteList := len(WhitelistInboundIPs) > 0
 
-		isInWhitelist := false
-		isInConstellation := strings.HasPrefix(ip, "192.168.201.") || strings.HasPrefix(ip, "192.168.202.")
+	isInWhitelist := false
+	isInConstellation := strings.HasPrefix(ip, "192.168.201.") || strings.HasPrefix(ip, "192.168.202.")
 
-		for _, ipRange := range WhitelistInboundIPs {
-			Debug("Checking if " + ip + " is in " + ipRange)
-			if strings.Contains(ipRange, "/") {
-				if ok, _ := IPInRange(ip, ipRange); ok {
-					isInWhitelist = true
-				}
-			} else {
-				if ip == ipRange {
-					isInWhitelist = true
-				}
+	for _, ipRange := range WhitelistInboundIPs {
+		Debug("Checking if " + ip + " is in " + ipRange)
+		if strings.Contains(ipRange, "/") {
+			if ok, _ := IPInRange(ip, ipRange); ok {
+				isInWhitelist = true
+			}
+		} else {
+			if ip == ipRange {
+				isInWhitelist = true
 			}
 		}
+	}
 
-		if(RestrictToConstellation) {
-			if(!isInConstellation) {
-				if(!isUsingWhiteList) {
-					PushShieldMetrics("ip-whitelists")
+	if(RestrictToConstellation) {
+		return isInConstellation || (isUsingWhiteList && isInWhitelist)
+	}
 
-					TriggerEvent(
-						"cosmos.proxy.shield.whitelist",
-						"Proxy Shield IP blocked by whitelist",
-						"warning",
-						"",
-						map[string]interface{}{
-						"clientID": ip,
-						"url": r.URL.String(),
-					})
+	return !isUsingWhiteList || isInWhitelist
+}
 
-					IncrementIPAbuseCounter(ip)
-					Error("Request from " + ip + " is blocked because of restrictions", nil)
-					Debug("Blocked by RestrictToConstellation isInConstellation isUsingWhiteList")
-					http.Error(w, "Access denied", http.StatusForbidden)
-					return
-				} else if (!isInWhitelist) {
-					PushShieldMetrics("ip-whitelists")
-					
-					TriggerEvent(
-						"cosmos.proxy.shield.whitelist",
-						"Proxy Shield IP blocked by whitelist",
-						"warning",
-						"",
-						map[string]interface{}{
-						"clientID": ip,
-						"url": r.URL.String(),
-					})
+func Restrictions(RestrictToConstellation bool, WhitelistInboundIPs []string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-					IncrementIPAbuseCounter(ip)
-					Error("Request from " + ip + " is blocked because of restrictions", nil)
-					Debug("Blocked by RestrictToConstellation isInConstellation isInWhitelist")
-					http.Error(w, "Access denied", http.StatusForbidden)
-					return
-				}
-			}
-		} else if(isUsingWhiteList && !isInWhitelist) {
+		ip := GetClientIP(r)
+		if ip == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if !IsAllowedByRestrictions(ip, RestrictToConstellation, WhitelistInboundIPs) {
 			PushShieldMetrics("ip-whitelists")
+			MarkAccessLogShield(r, "ip-whitelists")
 
 			TriggerEvent(
 				"cosmos.proxy.shield.whitelist",
@@ -545,7 +549,6 @@ func Restrictions(RestrictToConstellation bool, WhitelistInboundIPs []string) fu
 
 			IncrementIPAbuseCounter(ip)
 			Error("Request from " + ip + " is blocked because of restrictions", nil)
-			Debug("Blocked by RestrictToConstellation isInConstellation isUsingWhiteList isInWhitelist")
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
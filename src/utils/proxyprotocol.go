@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyProtocolTimeout = 5 * time.Second
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// ListenHTTP opens the listener of the HTTP(S) servers, reading the PROXY protocol
+// header sent by trusted proxies when ProxyProtocol is on
+func ListenHTTP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if GetMainConfig().HTTPConfig.ProxyProtocol {
+		Log("PROXY protocol enabled on " + addr)
+		return &proxyProtocolListener{Listener: listener}, nil
+	}
+
+	return listener, nil
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is read on first use, so a slow client does not block Accept
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+
+		// anyone else could spoof its address
+		tcpAddr, ok := c.remote.(*net.TCPAddr)
+		if !ok || !IsTrustedProxy(tcpAddr.IP) {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, err := readProxyProtocolHeader(c.reader)
+		if err != nil {
+			Error("PROXY protocol: invalid header from "+c.remote.String(), err)
+			c.err = err
+			return
+		}
+
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyProtocolHeader returns nil without error when there is no header,
+// or when the proxy sends its own health checks (LOCAL, UNKNOWN)
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		if prefix, err := reader.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyProtocolV1(reader)
+	case '\r':
+		if prefix, err := reader.Peek(len(proxyProtocolV2Signature)); err != nil || !bytes.Equal(prefix, proxyProtocolV2Signature) {
+			return nil, nil
+		}
+		return readProxyProtocolV2(reader)
+	}
+
+	return nil, nil
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	// 107 bytes at most, CRLF included
+	line := make([]byte, 0, 107)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, errors.New("v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 {
+		return nil, errors.New("invalid v1 header")
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid v1 source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported v2 version")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("v2 address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("v2 address too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+
+	// UNSPEC or unix sockets
+	return nil, nil
+}
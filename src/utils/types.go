@@ -45,6 +45,11 @@ var HTTPSCertModeList = map[string]string{
 	"LETSENCRYPT": "LETSENCRYPT",
 }
 
+var ACMEChallengeList = map[string]string{
+	"HTTP01": "HTTP-01",
+	"TLSALPN01": "TLS-ALPN-01",
+}
+
 type FileStats struct {
 	Name string `json:"name"`
 	Path string `json:"path"`
@@ -95,12 +100,35 @@ type Config struct {
 	ConstellationConfig ConstellationConfig
 	MonitoringDisabled bool
 	MonitoringAlerts map[string]Alert
+	Prometheus PrometheusConfig
 	BackupOutputDir string
 	DisableHostModeWarning bool
 	AdminWhitelistIPs []string
 	AdminConstellationOnly bool
 	Storage StorageConfig
 	CRON map[string]CRONConfig
+	AccessLog AccessLogConfig
+}
+
+type AccessLogConfig struct {
+	Enabled bool
+	// CLF or JSON, written to access.log in the config folder
+	Format string `validate:"omitempty,oneof=CLF JSON"`
+	// rotation, in MB (100 by default), number of files (5) and days (unlimited)
+	MaxSize int
+	MaxBackups int
+	MaxAge int
+	// also keep the entries in the database, to filter them from the API
+	Database bool
+	// 7 days by default
+	RetentionDays int
+}
+
+type PrometheusConfig struct {
+	Enabled bool
+	Token string
+	WhitelistInboundIPs []string
+	RestrictToConstellation bool
 }
 
 type CRONConfig struct {
@@ -156,6 +184,15 @@ type HTTPConfig struct {
 	GenerateMissingAuthCert bool
 	HTTPSCertificateMode string
 	DNSChallengeProvider string
+	// ACME server used by LETSENCRYPT mode, Let's Encrypt when empty
+	ACMEDirectoryURL string `validate:"omitempty,url"`
+	// External Account Binding, required by ZeroSSL or Google Trust Services
+	ACMEEABKeyID string
+	ACMEEABHMACKey string
+	// PEM bundle to trust a private ACME server
+	ACMECABundle string
+	// HTTP-01, TLS-ALPN-01 or both when empty, ignored with DNSChallengeProvider
+	ACMEChallenge string `validate:"omitempty,oneof=HTTP-01 TLS-ALPN-01"`
 	ForceHTTPSCertificateRenewal bool
 	HTTPPort string `validate:"required,containsany=0123456789,min=1,max=6"`
 	HTTPSPort string `validate:"required,containsany=0123456789,min=1,max=6"`
@@ -168,7 +205,14 @@ type HTTPConfig struct {
 	AcceptAllInsecureHostname bool
 	DNSChallengeConfig map[string]string `json:"DNSChallengeConfig,omitempty"`
 	UseForwardedFor bool
+	// CIDRs, IPs or presets (cloudflare, private, loopback) allowed to set X-Forwarded-For
+	// and to send the PROXY protocol, only loopback when empty
+	TrustedProxies []string
+	// read the PROXY protocol v1/v2 header sent by trusted proxies on the HTTP(S) listeners
+	ProxyProtocol bool
 	AllowSearchEngine bool
+	// how long connections of a stopped internal port proxy can keep going
+	InternalProxyDrainTimeout time.Duration
 } 
 
 const (
@@ -185,6 +229,11 @@ type SmartShieldPolicy struct {
 	PerUserSimultaneous int
 	MaxGlobalSimultaneous int
 	PrivilegedGroups int
+	StrikeDuration time.Duration
+	// strikes older than this do not count towards a temporary ban
+	StrikeWindow time.Duration
+	TempBanDuration time.Duration
+	BanExpiry time.Duration
 }
 
 type DockerConfig struct {
@@ -232,6 +281,86 @@ type ProxyRouteConfig struct {
 	OverwriteHostHeader string
 	WhitelistInboundIPs []string
 	Icon string
+	Targets []ProxyTarget
+	LoadBalancing LoadBalancingConfig
+	HealthCheck HealthCheckConfig
+	// port listened on by TCP and UDP routes
+	ListenPort string
+	// PEM certificate served for this route instead of the generated ones
+	TLSCert string
+	TLSKey string
+	ClientCertAuth ClientCertAuthConfig
+	HeaderRules []HeaderRule `validate:"dive"`
+	// matched against the path, PathRewrite can use its groups, ex: /$1
+	PathRegex string
+	PathRewrite string
+	// expression such as Host("a.com") && (PathPrefix("/api") || !ClientIP("10.0.0.0/8"))
+	MatchRule string
+	Cache RouteCacheConfig
+	Compression RouteCompressionConfig
+}
+
+type RouteCompressionConfig struct {
+	Enabled bool
+	// in order of preference, br, zstd and gzip by default
+	Encodings []string `validate:"dive,oneof=br zstd gzip"`
+	// ex: text/*, application/json, the common text formats by default
+	MimeTypes []string
+	// smaller responses are sent as is, in bytes, 1024 by default
+	MinSize int
+}
+
+type RouteCacheConfig struct {
+	Enabled bool
+	// in MB, 64 in memory and nothing on disk by default
+	MaxMemory int
+	MaxDisk int
+	// largest response kept, in MB, 8 by default
+	MaxObjectSize int
+	// used when the backend sends neither Cache-Control nor Expires, not cached when 0
+	DefaultTTL time.Duration
+	// how long a stale response is served while it is refreshed, when the backend does not say
+	StaleWhileRevalidate time.Duration
+}
+
+type HeaderRule struct {
+	Direction string `validate:"oneof=request response"`
+	Action string `validate:"oneof=set add remove replace"`
+	Name string `validate:"required"`
+	// can use {client_ip}, {user}, {route}, {host}... and $1 with replace
+	Value string
+	// regexp matched against the current value by replace
+	Pattern string
+}
+
+type ClientCertAuthConfig struct {
+	Enabled bool
+	// PEM of the accepted CAs, the internal CA of Cosmos when empty
+	CACert string
+}
+
+type HealthCheckConfig struct {
+	Enabled bool
+	Path string
+	// 0 accepts anything below 500
+	ExpectedStatus int
+	Interval time.Duration
+	Timeout time.Duration
+	MaintenancePage bool
+	MaintenanceMessage string
+}
+
+type ProxyTarget struct {
+	Target string
+	Weight int
+}
+
+type LoadBalancingConfig struct {
+	// ROUND_ROBIN (default), LEAST_CONN or IP_HASH
+	Strategy string
+	// consecutive failures before a target is ejected
+	MaxFails int
+	FailCooldown time.Duration
 }
 
 type EmailConfig struct {
@@ -267,18 +396,64 @@ type ConstellationConfig struct {
 	DNSDisabled bool
 	DNSPort string
 	DNSFallback string
+	// udp://, tcp://, tls:// (DoT) or https:// (DoH) servers, DNSFallback is used when empty
+	DNSUpstreams []string
+	// failover (default) uses the first healthy upstream, parallel races them
+	DNSUpstreamStrategy string `validate:"omitempty,oneof=failover parallel"`
+	DNSCacheDisabled bool
+	// in responses, 10000 by default
+	DNSCacheSize int
+	// keep every query in the database, the last 1000 are always kept in memory
+	DNSQueryLog bool
+	// 7 days by default
+	DNSQueryLogRetentionDays int
 	DNSBlockBlacklist bool
 	DNSAdditionalBlocklists []string
-	CustomDNSEntries []ConstellationDNSEntry
+	// URLs of DNSAdditionalBlocklists (or the dns-blacklist.txt path) not used for now
+	DNSBlocklistsDisabled []string
+	// 24 hours by default
+	DNSBlocklistsRefreshHours int
+	// a name blocks its subdomains too, *.example.com or ads*.example.com are wildcards and /regex/ are regexes
+	DNSBlockRules []string
+	// never blocked, same syntax as DNSBlockRules
+	DNSAllowlist []string
+	// null (default) answers 0.0.0.0 and ::, nxdomain that the name does not exist, custom the IPs below
+	DNSBlockingMode string `validate:"omitempty,oneof=null nxdomain custom"`
+	// custom mode, the A or AAAA queries without an IP get an empty answer
+	DNSBlockingIP string `validate:"omitempty,ipv4"`
+	DNSBlockingIPv6 string `validate:"omitempty,ipv6"`
+	CustomDNSEntries []ConstellationDNSEntry `validate:"dive"`
+	// used by the devices set to them, or by the devices of their users
+	DNSPolicies []ConstellationDNSPolicy `validate:"dive"`
 	NebulaConfig NebulaConfig
 	ConstellationHostname string
 }
 
 type ConstellationDNSEntry struct {
-	Type string
+	// A when empty, NXDOMAIN answers that the name does not exist
+	Type string `validate:"omitempty,oneof=A AAAA CNAME TXT MX SRV PTR NXDOMAIN"`
+	// exact name, or *.example.com for its subdomains
 	Key string
 	Value string
+	// in seconds, 3600 by default
+	TTL int
 }
+type ConstellationDNSPolicy struct {
+	Name string `validate:"required"`
+	// nicknames of the users whose devices use the policy, unless the device has its own
+	Users []string
+	// no blocking at all for the devices of the policy
+	BlockingDisabled bool
+	// used with the global lists and rules
+	Blocklists []string
+	BlockRules []string
+	Allowlist []string
+	// replace DNSUpstreams when set
+	Upstreams []string
+	// answered before the global CustomDNSEntries
+	CustomDNSEntries []ConstellationDNSEntry `validate:"dive"`
+}
+
 type ConstellationDevice struct {
 	Nickname string `json:"nickname" bson:"Nickname"`
 	DeviceName string `json:"deviceName" bson:"DeviceName"`
@@ -291,6 +466,8 @@ type ConstellationDevice struct {
 	Blocked bool `json:"blocked" bson:"Blocked"`
 	Fingerprint string `json:"fingerprint" 	bson:"Fingerprint"`
 	APIKey string `json:"-" bson:"APIKey"`
+	// name of the DNS policy, the one of the user when empty
+	DNSPolicy string `json:"dnsPolicy" bson:"DNSPolicy"`
 }
 
 type NebulaFirewallRule struct {
@@ -381,6 +558,9 @@ type Alert struct {
 	LastTriggered time.Time
 	Throttled bool
 	Severity string
+	PendingPeriods int
+	Cooldown time.Duration
+	NotifyResolved bool
 }
 
 type AlertCondition struct {
@@ -392,10 +572,17 @@ type AlertCondition struct {
 type AlertAction struct {
 	Type string
 	Target string
+	Headers map[string]string
+	Secret string
+	Template string
+	Retries int
+	Container string
+	Timeout int
 }
 
 type AlertMetricTrack struct {
 	Key string
 	Object string
 	Max uint64
+	Value int
 }
\ No newline at end of file
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"regexp"
 	"net/http"
+	"net/url"
 	"encoding/base64"
 	"os"
 	"strconv"
@@ -702,14 +703,6 @@ func DownloadFile(url string) (string, error) {
 	return string(body), nil
 }
 
-func GetClientIP(req *http.Request) string {
-	/*ip := req.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = req.RemoteAddr
-	}*/
-	return req.RemoteAddr
-}
-
 func IsDomain(domain string) bool {
 	// contains . and at least a letter and no special characters invalid in a domain
 	if strings.Contains(domain, ".") && strings.ContainsAny(domain, "abcdefghijklmnopqrstuvwxyz") && !strings.ContainsAny(domain, " !@#$%^&*()+=[]{}\\|;:'\",/<>?") {
@@ -813,4 +806,22 @@ func IsLocalIP(ip string) bool {
 		return true
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// ResolveContainerURL replaces a container name in the URL by its IP,
+// for when Cosmos is not running in the same Docker network as the container
+func ResolveContainerURL(siteurl string) (string, error) {
+	parsedURL, err := url.Parse(siteurl)
+	if err != nil {
+		return siteurl, err
+	}
+
+	hostname := parsedURL.Hostname()
+
+	ip, _ := GetContainerIPByName(hostname)
+	if ip != "" {
+		siteurl = strings.Replace(siteurl, hostname, ip, 1)
+	}
+
+	return siteurl, nil
+}